@@ -53,7 +53,7 @@ func (lw *LockedWriter) Write(str string) (n int, err error) {
 }
 
 func getKVConnectionToRaftLeader(t *testing.T) (string, pb.KvStoreClient) {
-	leaderId := getCurrentLeaderIDByGetRequest(t)
+	leaderId := getCurrentLeaderID(t)
 	endpoint := getKVServiceURL(t, leaderId)
 	kvc := establishConnection(t, endpoint)
 	return leaderId, kvc
@@ -114,7 +114,7 @@ func listAvailRaftServer(t *testing.T) []string {
 	return re.FindAllString(string(stdout), -1)
 }
 
-func getCurrentLeaderIDByGetRequest(t *testing.T) string {
+func getCurrentLeaderID(t *testing.T) string {
 	redirected := true
 	endpoint := getKVServiceURL(t, listAvailRaftServer(t)[0])
 	var leaderId string = listAvailRaftServer(t)[0]
@@ -122,9 +122,9 @@ func getCurrentLeaderIDByGetRequest(t *testing.T) string {
 	for redirected {
 		kvc := establishConnection(t, endpoint)
 
-		// Request value for hello
-		req := &pb.Key{Key: "hello"}
-		res, err := kvc.Get(context.Background(), req)
+		// Followers serve GET themselves, so probe with GetConfiguration, which only the leader answers
+		// and which doesn't append anything to the log.
+		res, err := kvc.GetConfiguration(context.Background(), &pb.Empty{})
 		if err != nil {
 			t.Fatalf("Request error %v", err)
 		}
@@ -135,7 +135,7 @@ func getCurrentLeaderIDByGetRequest(t *testing.T) string {
 			t.Logf("The given server is not Raft leader, redirect to leader \"%v\" ...", res.GetRedirect().Server)
 		default:
 			redirected = false
-			t.Logf("Got response key: \"%v\" value:\"%v\"", res.GetKv().Key, res.GetKv().Value)
+			t.Logf("Got configuration servers: \"%v\"", res.GetConfiguration().GetServers())
 		}
 
 		if redirected && res.GetRedirect().Server == "" {
@@ -332,13 +332,13 @@ func TestCas(t *testing.T) {
 	Test if a Raft server can redirect us to the leader if it is not the leader.
 */
 func TestRedirectionHandling(t *testing.T) {
-	leaderId := getCurrentLeaderIDByGetRequest(t)
+	leaderId := getCurrentLeaderID(t)
 
 	//fail the leader
 	failGivenRaftServer(t, leaderId)
 	time.Sleep(20 * time.Second)
 
-	getCurrentLeaderIDByGetRequest(t)
+	getCurrentLeaderID(t)
 
 	relaunchGivenRaftServer(t, leaderId)
 	//give time for relaunch and let it be stable
@@ -459,7 +459,7 @@ func TestCommitedLogsShouldSurviveAfterFailedNodesRejoin(t *testing.T) {
 	3. Make get requests, should get back what we set
 */
 func TestCommitedLogsShouldSurviveAfterFailedLeaderRejoin(t *testing.T) {
-	leaderId := getCurrentLeaderIDByGetRequest(t)
+	leaderId := getCurrentLeaderID(t)
 	failedNodes := []string{leaderId}
 	testCommitedLogsShouldSurviveAfterRejoin(t, failedNodes, "test_failed_leader_rejoin", "5")
 }
@@ -6,6 +6,7 @@ import copy
 import os
 import subprocess
 import sys
+import uuid
 import yaml
 
 def find_pods(v1):
@@ -43,7 +44,7 @@ def get_service(v1, service):
     """Get service spec for service"""
     return v1.list_service_for_all_namespaces(watch=False, field_selector="metadata.name=%s"%service)
 
-def boot_pod(v1, pod_spec, service_spec, name, peers):
+def boot_pod(v1, pod_spec, service_spec, name, peers, cluster_id=None, bootstrap=False):
     """Boot a single pod"""
     pod_spec = copy.deepcopy(pod_spec)
     # Create a pod spec for this pod.
@@ -51,11 +52,23 @@ def boot_pod(v1, pod_spec, service_spec, name, peers):
     pod_spec['metadata']['labels']['app'] = name
     pod_spec['spec']['containers'][0]['ports'][0]['name']="%s-client"%name
     pod_spec['spec']['containers'][0]['ports'][1]['name']="%s-raft"%name
+    # Keep the persisted Raft states on the host so they survive the pod being relaunched.
+    pod_spec['spec']['volumes'][0]['hostPath']['path']="/tmp/raft-data/%s"%name
     peers = filter(lambda p: p != name, peers)
-    args = ['server']
-    for peer in peers:
-        args.append('-peer')
-        args.append('%s:3001'%peer)
+    # The ID is kept as the raft address the other pods are given with -peer.
+    args = ['server', '-id', '%s:3001'%name]
+    if bootstrap:
+        # The pods booted together form the initial configuration.
+        args.append('-bootstrap')
+        for peer in peers:
+            args.append('-peer')
+            args.append('%s:3001'%peer)
+    elif peers:
+        # A pod without persisted states asks the running pods to add it, a relaunched pod ignores -join.
+        args.extend(['-join', ','.join('%s:3000'%peer for peer in peers)])
+    # A relaunched pod keeps the cluster ID saved in its data directory.
+    if cluster_id:
+        args.extend(['-cluster-id', cluster_id])
     pod_spec['spec']['containers'][0]['command'] = args
 
     service_spec = copy.deepcopy(service_spec)
@@ -93,14 +106,18 @@ def show(args):
 def boot(args):
     """Launch a set of pods"""
     v1 = init()
+    # A freshly booted cluster should not pick up the states of a previous one. The hostPath volumes live on the
+    # minikube node, not on this machine.
+    subprocess.run('minikube ssh -- sudo rm -rf /tmp/raft-data', check=True, shell=True)
     with open(os.path.join(sys.path[0], 'pod-template.yml')) as f:
         specs = list(yaml.load_all(f))
         pod_spec = specs[0]
         service_spec = specs[1]
         num_services = args.peers
         peers = ['peer%d'%i for i in range(num_services)]
+        cluster_id = str(uuid.uuid4())
         for peer in peers:
-            boot_pod(v1, pod_spec, service_spec, peer, peers)
+            boot_pod(v1, pod_spec, service_spec, peer, peers, cluster_id, bootstrap=True)
 
 def kill(args):
     """Kill selected peer"""
@@ -0,0 +1,457 @@
+/*
+	A client library for the Raft kv-store.
+
+	The client is given a static list of seed endpoints. It sends each request to the cached leader (or to a
+	seed when the leader is not known yet), follows the redirects to the leader, and retries with backoff
+	when the cluster currently has no leader or a server can't be reached, until the context is done. A follower
+	may serve reads, so only the server replying to a write or another leader-only request is cached as the leader.
+
+	Writes are made through a client session, so a write retried after a leader failure is applied at most
+	once by the cluster.
+*/
+
+package raftkv
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/raft/pb"
+)
+
+const (
+	DEFAULT_MIN_BACKOFF = 50 * time.Millisecond
+	DEFAULT_MAX_BACKOFF = 2 * time.Second
+
+	//keys of the grpc metadata carrying the session of a write, as expected by the server
+	clientIDMetadataKey = "client-id"
+	seqMetadataKey      = "seq"
+
+	//redirects followed in a row before backing off, they may bounce between servers with a stale leader
+	maxRedirects = 8
+
+	//the failure message the server replies for a write of an unknown or expired session
+	sessionExpiredMsg = "Unknown or expired client session, the client should register again."
+	//the failure message a server removed from the cluster replies to every request
+	removedMsg = "This server has been removed from the cluster."
+)
+
+// ErrSessionExpired is returned for a write whose session expired on the cluster before the write got through.
+// The write may or may not have been applied, the next write opens a new session.
+var ErrSessionExpired = errors.New("raftkv: client session expired")
+
+// A failure replied by the cluster, e.g. a rejected configuration change.
+type FailureError struct {
+	Msg string
+}
+
+func (e *FailureError) Error() string {
+	return "raftkv: " + e.Msg
+}
+
+// The configuration of the cluster as seen by the leader.
+type Configuration struct {
+	// The voting servers and the learners still catching up.
+	Servers  []string
+	Learners []string
+	// The log index of the config entry, to give as expectedConfigIndex.
+	Index int64
+	// Whether a configuration change is in progress.
+	Pending bool
+	// The addresses of the servers and learners.
+	Members []Member
+}
+
+// The addresses of a server of the cluster.
+type Member struct {
+	ID            string
+	RaftAddress   string
+	ClientAddress string
+}
+
+type Options struct {
+	// Maps the server of a redirect, the client endpoint of the leader, to the endpoint to connect to.
+	// By default the endpoint is used as is, a server without port (the leader's client address isn't known)
+	// gets the port of the first seed.
+	Resolve func(server string) string
+
+	// Bounds of the exponential backoff between retries, DEFAULT_MIN_BACKOFF / DEFAULT_MAX_BACKOFF if 0.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Extra options used to dial the servers, the connections are insecure.
+	DialOptions []grpc.DialOption
+}
+
+type Client struct {
+	seeds []string
+	opts  Options
+
+	mu sync.Mutex
+	//endpoint of the last known leader, empty if unknown
+	leader string
+	//index of the next seed to try when the leader is not known
+	nextSeed int
+	conns    map[string]*grpc.ClientConn
+
+	//serializes the writes, the server only caches the result of the latest write of a session
+	writeMu  sync.Mutex
+	clientID int64
+	seq      int64
+}
+
+// NewClient creates a client for the cluster reachable through the given seed endpoints (host:port).
+// opts may be nil to use the defaults.
+func NewClient(seeds []string, opts *Options) (*Client, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("raftkv: no seed endpoint given")
+	}
+
+	c := &Client{seeds: append([]string(nil), seeds...), conns: make(map[string]*grpc.ClientConn)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if c.opts.MaxBackoff <= 0 {
+		c.opts.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if c.opts.Resolve == nil {
+		_, port, err := net.SplitHostPort(seeds[0])
+		if err != nil {
+			return nil, fmt.Errorf("raftkv: invalid seed endpoint %q: %v", seeds[0], err)
+		}
+		c.opts.Resolve = func(server string) string {
+			if _, _, err := net.SplitHostPort(server); err == nil {
+				return server
+			}
+			return net.JoinHostPort(server, port)
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connections to all the servers.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for endpoint, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.conns, endpoint)
+	}
+	return firstErr
+}
+
+// Get returns the value of the key, an empty string if the key is not set, see Exists.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	res, err := c.read(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Get(ctx, &pb.Key{Key: key})
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.GetKv().Value, nil
+}
+
+// Set sets the key to the value.
+func (c *Client) Set(ctx context.Context, key string, value string) error {
+	_, err := c.write(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Set(ctx, &pb.KeyValue{Key: key, Value: value})
+	})
+	return err
+}
+
+// CAS sets the key to newValue if its current value is oldValue.
+// It returns the value of the key after the operation, i.e. newValue if the swap happened.
+func (c *Client) CAS(ctx context.Context, key string, oldValue string, newValue string) (string, error) {
+	res, err := c.write(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.CAS(ctx, &pb.CASArg{Kv: &pb.KeyValue{Key: key, Value: oldValue}, Value: &pb.Value{Value: newValue}})
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.GetKv().Value, nil
+}
+
+// Clear removes all the keys.
+func (c *Client) Clear(ctx context.Context) error {
+	_, err := c.write(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Clear(ctx, &pb.Empty{})
+	})
+	return err
+}
+
+// Delete removes the key, it returns whether the key was set.
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	res, err := c.write(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Delete(ctx, &pb.Key{Key: key})
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.GetKv().Found, nil
+}
+
+// Exists returns whether the key is set, also to the empty string.
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := c.read(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Exists(ctx, &pb.Key{Key: key})
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.GetKv().Found, nil
+}
+
+// A key and its value, as returned by the scans.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Range returns the keys from start (inclusive) to end (exclusive) in order, end may be empty for no upper bound.
+// If limit is positive at most limit keys are returned, more tells whether the limit cut the scan short.
+func (c *Client) Range(ctx context.Context, start string, end string, limit int64) (kvs []KeyValue, more bool, err error) {
+	res, err := c.read(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Range(ctx, &pb.RangeArg{Start: start, End: end, Limit: limit})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return keyValues(res.GetRange()), res.GetRange().GetMore(), nil
+}
+
+// Prefix returns the keys starting with the prefix in order.
+func (c *Client) Prefix(ctx context.Context, prefix string) ([]KeyValue, error) {
+	res, err := c.read(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.Prefix(ctx, &pb.Key{Key: prefix})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyValues(res.GetRange()), nil
+}
+
+func keyValues(kvs *pb.KeyValues) []KeyValue {
+	result := make([]KeyValue, len(kvs.GetKvs()))
+	for i, kv := range kvs.GetKvs() {
+		result[i] = KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	return result
+}
+
+// ChangeConfiguration replaces the servers of the cluster, currList has to match the current configuration.
+// Both lists are comma separated.
+func (c *Client) ChangeConfiguration(ctx context.Context, currList string, newList string) error {
+	_, err := c.do(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.ChangeConfiguration(ctx, &pb.Servers{CurrList: currList, NewList: newList})
+	})
+	return err
+}
+
+// AddServer adds the server to the cluster, raftAddress may be empty to use the id and clientAddress if unknown.
+// For a server already in the cluster, it updates the addresses that are not empty.
+// If expectedConfigIndex isn't 0, the request fails unless the configuration is still at that index.
+func (c *Client) AddServer(ctx context.Context, id string, raftAddress string, clientAddress string,
+	expectedConfigIndex int64) error {
+	_, err := c.do(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.AddServer(ctx, &pb.ServerChange{Id: id, Address: raftAddress, ClientAddress: clientAddress,
+			ExpectedConfigIndex: expectedConfigIndex})
+	})
+	return err
+}
+
+// RemoveServer removes the server from the cluster.
+// If expectedConfigIndex isn't 0, the request fails unless the configuration is still at that index.
+func (c *Client) RemoveServer(ctx context.Context, id string, expectedConfigIndex int64) error {
+	_, err := c.do(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.RemoveServer(ctx, &pb.ServerChange{Id: id, ExpectedConfigIndex: expectedConfigIndex})
+	})
+	return err
+}
+
+// GetConfiguration returns the latest configuration of the leader.
+func (c *Client) GetConfiguration(ctx context.Context) (*Configuration, error) {
+	res, err := c.do(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+		return kvc.GetConfiguration(ctx, &pb.Empty{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := res.GetConfiguration()
+	members := make([]Member, len(config.GetMembers()))
+	for i, member := range config.GetMembers() {
+		members[i] = Member{ID: member.Id, RaftAddress: member.RaftAddress, ClientAddress: member.ClientAddress}
+	}
+	return &Configuration{Servers: splitList(config.GetServers()), Learners: splitList(config.GetLearners()),
+		Index: config.GetIndex(), Pending: config.GetPending(), Members: members}, nil
+}
+
+//split a comma separated list of servers, an empty list has no server
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+//send the write with the session id and a new sequence number, the same sequence number is kept across retries
+func (c *Client) write(ctx context.Context,
+	call func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error)) (*pb.Result, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.clientID == 0 {
+		res, err := c.do(ctx, func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error) {
+			return kvc.RegisterClient(ctx, &pb.Empty{})
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.clientID = res.GetSession().ClientID
+		c.seq = 0
+	}
+	c.seq++
+
+	md := metadata.Pairs(clientIDMetadataKey, strconv.FormatInt(c.clientID, 10), seqMetadataKey, strconv.FormatInt(c.seq, 10))
+	res, err := c.do(metadata.NewOutgoingContext(ctx, md), call)
+	if failure, ok := err.(*FailureError); ok && failure.Msg == sessionExpiredMsg {
+		c.clientID = 0
+		return nil, ErrSessionExpired
+	}
+	return res, err
+}
+
+//send the request to the leader, following redirects and retrying until the context is done
+func (c *Client) do(ctx context.Context,
+	call func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error)) (*pb.Result, error) {
+	return c.send(ctx, true, call)
+}
+
+//send a read like do, but a follower may serve it as well, so the server that did isn't cached as the leader
+func (c *Client) read(ctx context.Context,
+	call func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error)) (*pb.Result, error) {
+	return c.send(ctx, false, call)
+}
+
+//the server replying successfully is cached as the leader if leaderOnly is set, i.e. only the leader serves the request
+func (c *Client) send(ctx context.Context, leaderOnly bool,
+	call func(ctx context.Context, kvc pb.KvStoreClient) (*pb.Result, error)) (*pb.Result, error) {
+	backoff := c.opts.MinBackoff
+	redirects := 0
+	for {
+		endpoint := c.currentEndpoint()
+		kvc, err := c.connect(endpoint)
+		var res *pb.Result
+		if err == nil {
+			res, err = call(ctx, kvc)
+		}
+
+		if err == nil {
+			switch res.Result.(type) {
+			case *pb.Result_Redirect:
+				if server := res.GetRedirect().Server; server != "" {
+					c.setLeader(c.opts.Resolve(server))
+					//follow the redirect right away
+					if redirects++; redirects < maxRedirects {
+						continue
+					}
+				} else {
+					//the server doesn't know the leader either, probably in the middle of an election
+					c.forgetLeader(endpoint)
+				}
+			case *pb.Result_Failure:
+				if res.GetFailure().Msg != removedMsg {
+					return nil, &FailureError{Msg: res.GetFailure().Msg}
+				}
+				//the server left the cluster, try another one
+				c.forgetLeader(endpoint)
+			default:
+				if leaderOnly {
+					c.setLeader(endpoint)
+				}
+				return res, nil
+			}
+		} else {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			//the server is unreachable, try another one
+			c.forgetLeader(endpoint)
+		}
+
+		redirects = 0
+		//sleep a random duration up to the current backoff
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+//the endpoint to send the next request to, the leader if known and the next seed otherwise
+func (c *Client) currentEndpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leader != "" {
+		return c.leader
+	}
+	endpoint := c.seeds[c.nextSeed]
+	c.nextSeed = (c.nextSeed + 1) % len(c.seeds)
+	return endpoint
+}
+
+func (c *Client) setLeader(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = endpoint
+}
+
+//drop the cached leader if it is still the given endpoint
+func (c *Client) forgetLeader(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == endpoint {
+		c.leader = ""
+	}
+}
+
+func (c *Client) connect(endpoint string) (pb.KvStoreClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.conns[endpoint]
+	if !ok {
+		var err error
+		// We use WithInsecure since we do not configure https for the cluster.
+		conn, err = grpc.Dial(endpoint, append([]grpc.DialOption{grpc.WithInsecure()}, c.opts.DialOptions...)...)
+		if err != nil {
+			return nil, err
+		}
+		c.conns[endpoint] = conn
+	}
+	return pb.NewKvStoreClient(conn), nil
+}
@@ -0,0 +1,418 @@
+package raftkv
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/raft/pb"
+)
+
+// A fake kv-store server, it serves requests if it is the leader and redirects to the leader otherwise.
+type fakeServer struct {
+	mu       sync.Mutex
+	name     string
+	leader   string
+	store    map[string]string
+	applied  int
+	sessions map[int64]int64
+	//replies with a redirect to an unknown leader for the given number of requests
+	noLeader int
+	//replies with a failure to every request, as a server removed from the cluster
+	removed bool
+	//serves the reads even as a follower, as with the read-index read mode
+	servesReads bool
+	//the configuration, only maintained by the leader
+	servers     []string
+	members     []*pb.Member
+	configIndex int64
+}
+
+func (f *fakeServer) redirect() (*pb.Result, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: removedMsg}}}, true
+	}
+	if f.noLeader > 0 {
+		f.noLeader--
+		return &pb.Result{Result: &pb.Result_Redirect{Redirect: &pb.Redirect{Server: ""}}}, true
+	}
+	if f.leader != f.name {
+		return &pb.Result{Result: &pb.Result_Redirect{Redirect: &pb.Redirect{Server: f.leader}}}, true
+	}
+	return nil, false
+}
+
+//apply a write once per session sequence number
+func (f *fakeServer) write(ctx context.Context, apply func()) *pb.Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	clientID, _ := strconv.ParseInt(md[clientIDMetadataKey][0], 10, 64)
+	seq, _ := strconv.ParseInt(md[seqMetadataKey][0], 10, 64)
+	if f.sessions[clientID] < seq {
+		f.sessions[clientID] = seq
+		apply()
+		f.applied++
+	}
+	return &pb.Result{Result: &pb.Result_S{S: &pb.Success{}}}
+}
+
+func (f *fakeServer) Get(ctx context.Context, key *pb.Key) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok && !f.servesReads {
+		return res, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: key.Key, Value: f.store[key.Key]}}}, nil
+}
+
+func (f *fakeServer) Set(ctx context.Context, in *pb.KeyValue) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	return f.write(ctx, func() { f.store[in.Key] = in.Value }), nil
+}
+
+func (f *fakeServer) Clear(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	return f.write(ctx, func() { f.store = make(map[string]string) }), nil
+}
+
+func (f *fakeServer) CAS(ctx context.Context, in *pb.CASArg) (*pb.Result, error) {
+	return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "not supported"}}}, nil
+}
+
+func (f *fakeServer) Delete(ctx context.Context, key *pb.Key) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	found := false
+	f.write(ctx, func() {
+		_, found = f.store[key.Key]
+		delete(f.store, key.Key)
+	})
+	return &pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: key.Key, Found: found}}}, nil
+}
+
+func (f *fakeServer) Exists(ctx context.Context, key *pb.Key) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.store[key.Key]
+	return &pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: key.Key, Found: found}}}, nil
+}
+
+func (f *fakeServer) Range(ctx context.Context, in *pb.RangeArg) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.store {
+		if k >= in.Start && (in.End == "" || k < in.End) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	kvs := &pb.KeyValues{}
+	if in.Limit > 0 && int64(len(keys)) > in.Limit {
+		keys, kvs.More = keys[:in.Limit], true
+	}
+	for _, k := range keys {
+		kvs.Kvs = append(kvs.Kvs, &pb.KeyValue{Key: k, Value: f.store[k], Found: true})
+	}
+	return &pb.Result{Result: &pb.Result_Range{Range: kvs}}, nil
+}
+
+func (f *fakeServer) Prefix(ctx context.Context, in *pb.Key) (*pb.Result, error) {
+	return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "not supported"}}}, nil
+}
+
+func (f *fakeServer) ChangeConfiguration(ctx context.Context, in *pb.Servers) (*pb.Result, error) {
+	return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "not supported"}}}, nil
+}
+
+func (f *fakeServer) TransferLeadership(ctx context.Context, in *pb.LeaderTransfer) (*pb.Result, error) {
+	return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "not supported"}}}, nil
+}
+
+func (f *fakeServer) AddServer(ctx context.Context, in *pb.ServerChange) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if in.ExpectedConfigIndex != 0 && in.ExpectedConfigIndex != f.configIndex {
+		return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "configuration index mismatch"}}}, nil
+	}
+	f.servers = append(f.servers, in.Id)
+	f.members = append(f.members, &pb.Member{Id: in.Id, RaftAddress: in.Address, ClientAddress: in.ClientAddress})
+	f.configIndex++
+	return &pb.Result{Result: &pb.Result_S{S: &pb.Success{}}}, nil
+}
+
+func (f *fakeServer) RemoveServer(ctx context.Context, in *pb.ServerChange) (*pb.Result, error) {
+	return &pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "not supported"}}}, nil
+}
+
+func (f *fakeServer) GetConfiguration(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.Result{Result: &pb.Result_Configuration{Configuration: &pb.Configuration{
+		Servers: strings.Join(f.servers, ","), Index: f.configIndex, Members: f.members}}}, nil
+}
+
+func (f *fakeServer) RegisterClient(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
+	if res, ok := f.redirect(); ok {
+		return res, nil
+	}
+	return &pb.Result{Result: &pb.Result_Session{Session: &pb.Session{ClientID: 1}}}, nil
+}
+
+//start fake servers named peer0, peer1... with peer<leader> as the leader, returns their endpoints by name
+func startFakeCluster(t *testing.T, n int, leader int) ([]*fakeServer, map[string]string) {
+	servers := make([]*fakeServer, n)
+	endpoints := make(map[string]string)
+	for i := range servers {
+		servers[i] = &fakeServer{name: "peer" + strconv.Itoa(i), leader: "peer" + strconv.Itoa(leader),
+			store: make(map[string]string), sessions: make(map[int64]int64)}
+
+		c, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Could not create listening socket %v", err)
+		}
+		s := grpc.NewServer()
+		pb.RegisterKvStoreServer(s, servers[i])
+		go s.Serve(c)
+		t.Cleanup(s.Stop)
+		endpoints[servers[i].name] = c.Addr().String()
+	}
+	return servers, endpoints
+}
+
+func TestFollowRedirectToLeader(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 3, 2)
+	c, err := NewClient([]string{endpoints["peer0"]}, &Options{Resolve: func(server string) string { return endpoints[server] }})
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Set(ctx, "hello", "1"); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if v, err := c.Get(ctx, "hello"); err != nil || v != "1" {
+		t.Fatalf("Get returned %q, %v", v, err)
+	}
+	if servers[2].applied != 1 || servers[0].applied != 0 {
+		t.Fatalf("Write should be applied by the leader only")
+	}
+
+	_, err = c.CAS(ctx, "hello", "1", "2")
+	if _, ok := err.(*FailureError); !ok {
+		t.Fatalf("CAS should return the failure of the server, got %v", err)
+	}
+}
+
+func TestReadServedByFollower(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 3, 2)
+	servers[0].servesReads = true
+	servers[0].store["hello"] = "1"
+	c, err := NewClient([]string{endpoints["peer0"]}, &Options{Resolve: func(server string) string { return endpoints[server] }})
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if v, err := c.Get(ctx, "hello"); err != nil || v != "1" {
+		t.Fatalf("Get returned %q, %v", v, err)
+	}
+	if c.leader != "" {
+		t.Fatalf("The follower serving the read should not be cached as the leader, got %s", c.leader)
+	}
+
+	if err := c.Set(ctx, "hello", "2"); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if c.leader != endpoints["peer2"] {
+		t.Fatalf("The leader should be cached after a write, got %s", c.leader)
+	}
+	//the cached leader serves the next read
+	if v, err := c.Get(ctx, "hello"); err != nil || v != "2" {
+		t.Fatalf("Get returned %q, %v", v, err)
+	}
+	if c.leader != endpoints["peer2"] {
+		t.Fatalf("The leader should stay cached after a read, got %s", c.leader)
+	}
+}
+
+func TestRedirectToClientEndpoint(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 2, 1)
+	//the redirect carries the client endpoint of the leader, which the client connects to as is
+	servers[0].leader = endpoints["peer1"]
+	c, err := NewClient([]string{endpoints["peer0"]}, nil)
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Set(ctx, "hello", "1"); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if servers[1].applied != 1 {
+		t.Fatalf("Write should be applied by the leader")
+	}
+}
+
+func TestRetryWhileNoLeader(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 2, 1)
+	servers[0].noLeader = 3
+	c, err := NewClient([]string{endpoints["peer0"]},
+		&Options{Resolve: func(server string) string { return endpoints[server] }, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Get(ctx, "hello"); err != nil {
+		t.Fatalf("Get failed %v", err)
+	}
+
+	//the deadline is honored while there is no leader
+	servers[1].noLeader = 1 << 30
+	c.setLeader(endpoints["peer1"])
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "hello"); err != context.DeadlineExceeded {
+		t.Fatalf("Get should fail with the deadline, got %v", err)
+	}
+}
+
+func TestSkipRemovedServer(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 2, 1)
+	servers[0].removed = true
+	c, err := NewClient([]string{endpoints["peer0"], endpoints["peer1"]},
+		&Options{Resolve: func(server string) string { return endpoints[server] }, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Set(ctx, "hello", "1"); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if servers[1].applied != 1 {
+		t.Fatalf("Write should be applied by the leader")
+	}
+}
+
+func TestMembershipRequests(t *testing.T) {
+	servers, endpoints := startFakeCluster(t, 2, 1)
+	servers[1].servers = []string{"peer0", "peer1"}
+	servers[1].configIndex = 1
+	c, err := NewClient([]string{endpoints["peer0"]}, &Options{Resolve: func(server string) string { return endpoints[server] }})
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	config, err := c.GetConfiguration(ctx)
+	if err != nil {
+		t.Fatalf("GetConfiguration failed %v", err)
+	}
+	if len(config.Servers) != 2 || config.Learners != nil || config.Index != 1 {
+		t.Fatalf("Unexpected configuration %+v", config)
+	}
+
+	if err := c.AddServer(ctx, "peer2", "host2:3001", "host2:3000", config.Index); err != nil {
+		t.Fatalf("AddServer failed %v", err)
+	}
+	//the configuration moved on, a request based on the old one fails
+	if err := c.AddServer(ctx, "peer3", "", "", config.Index); err == nil {
+		t.Fatalf("AddServer should fail on a stale configuration index")
+	} else if _, ok := err.(*FailureError); !ok {
+		t.Fatalf("AddServer should fail with a FailureError, got %v", err)
+	}
+	if config, err = c.GetConfiguration(ctx); err != nil || len(config.Servers) != 3 || config.Index != 2 {
+		t.Fatalf("Unexpected configuration %+v, %v", config, err)
+	}
+	if len(config.Members) != 1 || config.Members[0] != (Member{ID: "peer2", RaftAddress: "host2:3001", ClientAddress: "host2:3000"}) {
+		t.Fatalf("Unexpected members %+v", config.Members)
+	}
+}
+
+func TestDeleteExistsAndRange(t *testing.T) {
+	_, endpoints := startFakeCluster(t, 1, 0)
+	c, err := NewClient([]string{endpoints["peer0"]}, nil)
+	if err != nil {
+		t.Fatalf("Could not create client %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := c.Set(ctx, key, "v"+key); err != nil {
+			t.Fatalf("Set failed %v", err)
+		}
+	}
+	//a key set to the empty string exists
+	if err := c.Set(ctx, "e", ""); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if found, err := c.Exists(ctx, "e"); err != nil || !found {
+		t.Fatalf("Exists of a key set to the empty string should be true, got %v, %v", found, err)
+	}
+
+	if found, err := c.Delete(ctx, "c"); err != nil || !found {
+		t.Fatalf("Delete of a set key should report it found, got %v, %v", found, err)
+	}
+	if found, err := c.Delete(ctx, "c"); err != nil || found {
+		t.Fatalf("Delete of a missing key should report it not found, got %v, %v", found, err)
+	}
+	if found, err := c.Exists(ctx, "c"); err != nil || found {
+		t.Fatalf("Exists of a deleted key should be false, got %v, %v", found, err)
+	}
+
+	kvs, more, err := c.Range(ctx, "b", "", 2)
+	if err != nil {
+		t.Fatalf("Range failed %v", err)
+	}
+	if expected := []KeyValue{{"b", "vb"}, {"d", "vd"}}; !reflect.DeepEqual(kvs, expected) || !more {
+		t.Fatalf("Unexpected range %v, more %v", kvs, more)
+	}
+	if kvs, more, err = c.Range(ctx, "a", "d", 0); err != nil || len(kvs) != 2 || more {
+		t.Fatalf("Unexpected range %v, more %v, %v", kvs, more, err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+)
+
+// Collects the client requests from in into batches for the main loop (group commit).
+// Requests keep being collected while the main loop is busy with the previous batch, a batch is handed over
+// once it has maxBatch requests, or maxWait after its first request (right away if maxWait is 0).
+func batchRequests(in chan InputChannelType, out chan []InputChannelType, maxBatch int, maxWait time.Duration) {
+	var batch []InputChannelType
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	for {
+		//nil channels block forever, which disables the corresponding case below
+		var ready chan []InputChannelType
+		if len(batch) >= maxBatch || (len(batch) > 0 && timeout == nil) {
+			ready = out
+		}
+		var input chan InputChannelType
+		if len(batch) < maxBatch {
+			input = in
+		}
+
+		select {
+		case op := <-input:
+			if len(batch) == 0 && maxWait > 0 {
+				timer = time.NewTimer(maxWait)
+				timeout = timer.C
+			}
+			batch = append(batch, op)
+		case <-timeout:
+			timeout = nil
+		case ready <- batch:
+			batch = nil
+			if timeout != nil {
+				timer.Stop()
+				timeout = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raft/pb"
+)
+
+func batchSeqs(batch []InputChannelType) []int64 {
+	seqs := []int64{}
+	for _, op := range batch {
+		seqs = append(seqs, op.command.Seq)
+	}
+	return seqs
+}
+
+func TestBatchRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBatch int
+		maxWait  time.Duration
+		requests int
+		batches  [][]int64
+	}{
+		//the main loop is busy until all the requests are sent
+		{"single batch", 10, 0, 3, [][]int64{{1, 2, 3}}},
+		{"full batch while the main loop is busy", 2, 0, 2, [][]int64{{1, 2}}},
+		//full batches don't wait for maxWait
+		{"cut at maxBatch", 3, time.Hour, 6, [][]int64{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan InputChannelType)
+			out := make(chan []InputChannelType)
+			go batchRequests(in, out, tt.maxBatch, tt.maxWait)
+
+			sent := make(chan bool)
+			go func() {
+				for i := 1; i <= tt.requests; i++ {
+					in <- InputChannelType{command: pb.Command{Seq: int64(i)}}
+				}
+				close(sent)
+			}()
+			//only the requests that fit in the batches not taken yet are accepted
+			if tt.requests <= tt.maxBatch {
+				<-sent
+			}
+
+			for i, want := range tt.batches {
+				select {
+				case batch := <-out:
+					if seqs := batchSeqs(batch); !reflect.DeepEqual(seqs, want) {
+						t.Fatalf("Batch %d has requests %v, want %v", i, seqs, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Batch %d was never handed over", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchRequestsWithoutWait(t *testing.T) {
+	in := make(chan InputChannelType)
+	out := make(chan []InputChannelType)
+	go batchRequests(in, out, 10, 0)
+
+	//with an idle main loop, every request goes right away on its own
+	for i := int64(1); i <= 3; i++ {
+		in <- InputChannelType{command: pb.Command{Seq: i}}
+		select {
+		case batch := <-out:
+			if seqs := batchSeqs(batch); !reflect.DeepEqual(seqs, []int64{i}) {
+				t.Fatalf("Got batch %v, want [%d]", seqs, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Request %d was not handed over right away", i)
+		}
+	}
+}
+
+func TestBatchRequestsMaxWait(t *testing.T) {
+	in := make(chan InputChannelType)
+	out := make(chan []InputChannelType)
+	maxWait := 50 * time.Millisecond
+	go batchRequests(in, out, 10, maxWait)
+
+	start := time.Now()
+	in <- InputChannelType{command: pb.Command{Seq: 1}}
+	batch := <-out
+	if elapsed := time.Since(start); elapsed < maxWait {
+		t.Fatalf("The batch was handed over after %v, before maxWait %v", elapsed, maxWait)
+	}
+	if seqs := batchSeqs(batch); !reflect.DeepEqual(seqs, []int64{1}) {
+		t.Fatalf("Got batch %v, want [1]", seqs)
+	}
+
+	//the timer starts again with the first request of the next batch
+	start = time.Now()
+	in <- InputChannelType{command: pb.Command{Seq: 2}}
+	in <- InputChannelType{command: pb.Command{Seq: 3}}
+	batch = <-out
+	if elapsed := time.Since(start); elapsed < maxWait {
+		t.Fatalf("The batch was handed over after %v, before maxWait %v", elapsed, maxWait)
+	}
+	if seqs := batchSeqs(batch); !reflect.DeepEqual(seqs, []int64{2, 3}) {
+		t.Fatalf("Got batch %v, want [2 3]", seqs)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+	Cluster ID.
+
+	A cluster is identified by a random UUID generated when it is bootstrapped, i.e. by a server started without
+	any peer, or given to all of its servers with -cluster-id. It is persisted in the data directory and carried
+	in every Raft RPC and reply. A server rejects an RPC from another cluster before it touches its state, and
+	the sender drops a reply from another cluster like a failed RPC, so a server left over from an old cluster
+	or a misconfigured address can't corrupt the terms, votes or logs of this one.
+
+	Only a server started with -join, which has no cluster ID until it is added, adopts the ID of the first
+	leader that sends it entries or a snapshot. A bootstrapped server always has its ID from the start, and a
+	server without one from before cluster IDs only talks to servers without one either.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+)
+
+//the id of our cluster, empty if we don't know it yet
+func (r *Raft) getClusterID() string {
+	r.clusterMu.Lock()
+	defer r.clusterMu.Unlock()
+	return r.clusterID
+}
+
+//returns an error if the given cluster id, from an RPC or a reply, is not ours.
+//as long as we wait to join a cluster, any other is accepted
+func (r *Raft) checkClusterID(id string) error {
+	r.clusterMu.Lock()
+	ours, adopting := r.clusterID, r.adoptClusterIDOnJoin
+	r.clusterMu.Unlock()
+	if id != ours && !adopting {
+		log.Printf("Rejected a Raft RPC from cluster %q, we belong to cluster %s.", id, ours)
+		return fmt.Errorf("cluster id mismatch: %q is not %s", id, ours)
+	}
+	return nil
+}
+
+//adopt the cluster id of the leader if we are waiting to join a cluster, returns false if it is not ours
+func (r *Raft) adoptClusterID(id string) bool {
+	r.clusterMu.Lock()
+	defer r.clusterMu.Unlock()
+	if !r.adoptClusterIDOnJoin || id == "" {
+		return id == r.clusterID
+	}
+
+	r.persister.SaveClusterID(id)
+	r.clusterID = id
+	r.adoptClusterIDOnJoin = false
+	log.Printf("Joined cluster %s.", id)
+	return true
+}
+
+//a random (version 4) UUID
+func newClusterID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClusterID(t *testing.T) {
+	tests := []struct {
+		name     string
+		ours     string
+		joining  bool
+		id       string
+		accepted bool
+		adopted  string
+	}{
+		{"same cluster", "c1", false, "c1", true, "c1"},
+		{"other cluster", "c1", false, "c2", false, "c1"},
+		{"no id from the sender", "c1", false, "", false, "c1"},
+		//a bootstrapped server never takes the id of another cluster, even without one
+		{"member without an id", "", false, "c2", false, ""},
+		{"member without an id, sender without one", "", false, "", true, ""},
+		{"joining", "", true, "c2", true, "c2"},
+		{"joining, sender without an id", "", true, "", true, ""},
+		{"joining with -cluster-id", "c1", false, "c2", false, "c1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Raft{persister: MakePersister(t.TempDir()), clusterID: tt.ours, adoptClusterIDOnJoin: tt.joining}
+			defer r.persister.wal.Close()
+
+			if err := r.checkClusterID(tt.id); (err == nil) != tt.accepted {
+				t.Fatalf("checkClusterID(%q) returned %v, want accepted: %v", tt.id, err, tt.accepted)
+			}
+			if ok := r.adoptClusterID(tt.id); ok != tt.accepted {
+				t.Fatalf("adoptClusterID(%q) returned %v, want %v", tt.id, ok, tt.accepted)
+			}
+			if id := r.getClusterID(); id != tt.adopted {
+				t.Fatalf("Cluster id is %q after adoptClusterID(%q), want %q", id, tt.id, tt.adopted)
+			}
+		})
+	}
+
+	//once joined, the ids of other clusters are rejected
+	r := &Raft{persister: MakePersister(t.TempDir()), adoptClusterIDOnJoin: true}
+	defer r.persister.wal.Close()
+	r.adoptClusterID("c1")
+	if err := r.checkClusterID("c2"); err == nil {
+		t.Fatalf("An RPC from another cluster should be rejected once joined")
+	}
+	if r.adoptClusterID("c2") {
+		t.Fatalf("Another cluster id should not be adopted once joined")
+	}
+}
@@ -64,14 +64,20 @@ func (a *arrayPeers) Merge(other *arrayPeers) *arrayPeers {
 // votes. This should include the local server, if it's a member of the cluster.
 // The servers are listed no particular order, but each should only appear once.
 // These entries are appended to the log during membership changes.
+// Learners receive the log but don't vote, nor count toward the quorum, until
+// they have caught up with the leader and are promoted.
 type Configuration struct {
-	servers *arrayPeers
+	servers  *arrayPeers
+	learners *arrayPeers
 }
 
 // Clone makes a deep copy of a Configuration.
 func (c *Configuration) Clone() Configuration {
 	var newConfig Configuration
 	newConfig.servers = c.servers.Clone()
+	if c.learners != nil {
+		newConfig.learners = c.learners.Clone()
+	}
 	return newConfig
 }
 
@@ -80,12 +86,10 @@ func (c *Configuration) Clone() Configuration {
 // configuration at a time (the next configuration may not be created until the
 // prior one has been committed).
 //
-// One downside to storing just two configurations is that if you try to take a
-// snapshot when your state machine hasn't yet applied the committedIndex, we
-// have no record of the configuration that would logically fit into that
-// snapshot. We disallow snapshots in that case now. An alternative approach,
-// which LogCabin uses, is to track every configuration change in the
-// log.
+// A snapshot records the latest config entry it includes (possibly a joint
+// one) together with its index, so the configuration can still be restored
+// once that entry is compacted away, and snapshots are allowed in the middle
+// of a membership change.
 type Configurations struct {
 	// committed is the latest configuration in the log/snapshot that has been
 	// committed (the one with the largest index).
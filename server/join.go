@@ -0,0 +1,121 @@
+/*
+	Bootstrapping and joining a cluster.
+
+	A server started with an empty data directory either bootstraps a new cluster or joins an existing one:
+	-bootstrap writes the initial configuration, the server itself and its -peer servers, as the config entry at
+	index 0, once, and all the servers of a cluster bootstrapped together must be given the same configuration.
+	-join starts the server without any configuration and asks the cluster, through the given client endpoints,
+	to add it with AddServer. It doesn't campaign and accepts the log of the first leader that sends it entries,
+	as a learner and then as a voter once the leader promotes it.
+
+	Once the server has persisted states it restarts from its persisted configuration and the flags are ignored,
+	except that a server that was not added yet keeps asking to join.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/raft/pb"
+)
+
+const (
+	//in ms, between two attempts to join the cluster
+	JOIN_RETRY_INTERVAL = 1000
+	//in ms, an AddServer request lasts until the server has caught up with the leader's log
+	JOIN_TIMEOUT = 60000
+)
+
+//the config entry at index 0 of a new cluster, formed by us and the given peers
+func (r *Raft) bootstrap(peers *arrayPeers) {
+	serverList := peers.Clone()
+	serverList.Set(r.me) // the configuration should include the current server itself
+	members := []*pb.Member{r.ownMember()}
+	for _, peer := range *peers {
+		members = append(members, &pb.Member{Id: peer, RaftAddress: r.opts.peerAddresses[peer]})
+	}
+	log.Printf("Bootstrapping a new cluster with servers %v.", serverList)
+	r.appendInitialConfig(&pb.Servers{CurrList: serverList.String(), Members: members})
+}
+
+//an empty config entry at index 0, the configuration comes with the leader's log once we are added
+func (r *Raft) prepareToJoin() {
+	log.Printf("Joining an existing cluster.")
+	r.appendInitialConfig(&pb.Servers{})
+}
+
+func (r *Raft) appendInitialConfig(servers *pb.Servers) {
+	initialConfigCmd := &pb.Command{Operation: pb.Op_CONFIG_CHG, Arg: &pb.Command_Servers{Servers: servers}}
+	//first dummy term for indexing convenience
+	r.addLogEntry(&pb.Entry{Term: 0, Index: 0, Cmd: initialConfigCmd})
+	r.updateConfiguration()
+	r.persist()
+}
+
+//whether we have no configuration yet, i.e. we are waiting to be added to a cluster
+func (r *Raft) isJoining() bool {
+	return len(*r.getMembers()) == 0
+}
+
+//ask the cluster to add us until it has, following redirects to the leader
+func (r *Raft) join(seeds []string) {
+	change := &pb.ServerChange{Id: r.me, Address: r.opts.raftAddress, ClientAddress: r.opts.clientAddress}
+	endpoint := seeds[0]
+	for attempt := 1; ; attempt++ {
+		result, err := addServer(endpoint, change)
+		if err != nil {
+			log.Printf("Could not ask %s to add us to the cluster: %v", endpoint, err)
+			endpoint = seeds[attempt%len(seeds)]
+			time.Sleep(JOIN_RETRY_INTERVAL * time.Millisecond)
+			continue
+		}
+
+		switch res := result.Result.(type) {
+		case *pb.Result_S:
+			log.Printf("Added to the cluster by %s.", endpoint)
+			return
+		case *pb.Result_Redirect:
+			if leader := res.Redirect.Server; leader != "" {
+				endpoint = joinEndpoint(leader, seeds[0])
+				continue
+			}
+		case *pb.Result_Failure:
+			if res.Failure.Msg == alreadyMemberMsg {
+				log.Printf("Already a member of the cluster.")
+				return
+			}
+			log.Printf("Join request failed: %s", res.Failure.Msg)
+		}
+		time.Sleep(JOIN_RETRY_INTERVAL * time.Millisecond)
+	}
+}
+
+//send an AddServer request to the given client endpoint
+func addServer(endpoint string, change *pb.ServerChange) (*pb.Result, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), JOIN_TIMEOUT*time.Millisecond)
+	defer cancel()
+	return pb.NewKvStoreClient(conn).AddServer(ctx, change)
+}
+
+//the endpoint of a redirect, the leader's client address or only its host, which is then given the seed's port
+func joinEndpoint(server string, seed string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	if _, port, err := net.SplitHostPort(seed); err == nil {
+		return net.JoinHostPort(server, port)
+	}
+	return server
+}
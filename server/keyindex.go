@@ -0,0 +1,111 @@
+/*
+	The ordered index of the kv-store keys for range and prefix scans, a skip list.
+
+	Inserting or deleting a key takes O(log n) expected time, and a scan walks the bottom level from the first
+	key not less than its start. The index only holds the keys, the values stay in the kv-store maps. It is only
+	used from the main loop and is not safe for concurrent use.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	keyIndexMaxLevel = 32
+	//the probability for a node to reach the next level is 1/keyIndexBranching
+	keyIndexBranching = 4
+)
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+type keyIndex struct {
+	head  keyIndexNode
+	level int
+	len   int
+	rand  *rand.Rand
+
+	//the last node before the key looked up on each level, reused across calls
+	update [keyIndexMaxLevel]*keyIndexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{head: keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)}, level: 1,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Len is the number of keys in the index.
+func (ki *keyIndex) Len() int {
+	return ki.len
+}
+
+// Insert adds the key, it returns false if the key was already there.
+func (ki *keyIndex) Insert(key string) bool {
+	if node := ki.seek(key); node != nil && node.key == key {
+		return false
+	}
+
+	level := ki.randomLevel()
+	if level > ki.level {
+		for l := ki.level; l < level; l++ {
+			ki.update[l] = &ki.head
+		}
+		ki.level = level
+	}
+	node := &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = ki.update[l].next[l]
+		ki.update[l].next[l] = node
+	}
+	ki.len++
+	return true
+}
+
+// Delete removes the key, it returns false if the key was not there.
+func (ki *keyIndex) Delete(key string) bool {
+	node := ki.seek(key)
+	if node == nil || node.key != key {
+		return false
+	}
+
+	for l := range node.next {
+		ki.update[l].next[l] = node.next[l]
+	}
+	for ki.level > 1 && ki.head.next[ki.level-1] == nil {
+		ki.level--
+	}
+	ki.len--
+	return true
+}
+
+// Ascend calls fn on the keys not less than start in order, until fn returns false.
+func (ki *keyIndex) Ascend(start string, fn func(key string) bool) {
+	for node := ki.seek(start); node != nil && fn(node.key); node = node.next[0] {
+	}
+}
+
+//the first node whose key is not less than the given one, nil if there is none,
+//the nodes before it on each level are left in ki.update
+func (ki *keyIndex) seek(key string) *keyIndexNode {
+	node := &ki.head
+	for l := ki.level - 1; l >= 0; l-- {
+		for node.next[l] != nil && node.next[l].key < key {
+			node = node.next[l]
+		}
+		ki.update[l] = node
+	}
+	return node.next[0]
+}
+
+func (ki *keyIndex) randomLevel() int {
+	level := 1
+	for level < keyIndexMaxLevel && ki.rand.Intn(keyIndexBranching) == 0 {
+		level++
+	}
+	return level
+}
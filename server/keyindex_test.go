@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func ascendKeys(ki *keyIndex, start string, limit int) []string {
+	keys := []string{}
+	ki.Ascend(start, func(key string) bool {
+		if len(keys) == limit {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestKeyIndex(t *testing.T) {
+	ki := newKeyIndex()
+	if keys := ascendKeys(ki, "", -1); len(keys) != 0 {
+		t.Fatalf("Empty index returned %q", keys)
+	}
+
+	steps := []struct {
+		insert bool
+		key    string
+		ok     bool
+		keys   []string
+	}{
+		{true, "b", true, []string{"b"}},
+		{true, "a", true, []string{"a", "b"}},
+		{true, "c", true, []string{"a", "b", "c"}},
+		{true, "b", false, []string{"a", "b", "c"}},
+		{true, "", true, []string{"", "a", "b", "c"}},
+		{false, "x", false, []string{"", "a", "b", "c"}},
+		{false, "b", true, []string{"", "a", "c"}},
+		{false, "b", false, []string{"", "a", "c"}},
+		{false, "", true, []string{"a", "c"}},
+		{true, "b", true, []string{"a", "b", "c"}},
+		{false, "a", true, []string{"b", "c"}},
+		{false, "c", true, []string{"b"}},
+		{false, "b", true, []string{}},
+	}
+	for i, step := range steps {
+		var ok bool
+		if step.insert {
+			ok = ki.Insert(step.key)
+		} else {
+			ok = ki.Delete(step.key)
+		}
+		if ok != step.ok {
+			t.Fatalf("Step %d: insert %v of %q returned %v, want %v", i, step.insert, step.key, ok, step.ok)
+		}
+		if keys := ascendKeys(ki, "", -1); !reflect.DeepEqual(keys, step.keys) {
+			t.Fatalf("Step %d: index holds %q, want %q", i, keys, step.keys)
+		}
+		if ki.Len() != len(step.keys) {
+			t.Fatalf("Step %d: Len() = %d, want %d", i, ki.Len(), len(step.keys))
+		}
+	}
+}
+
+func TestKeyIndexAscend(t *testing.T) {
+	ki := newKeyIndex()
+	for _, key := range []string{"d", "b", "a", "e", "c"} {
+		ki.Insert(key)
+	}
+
+	tests := []struct {
+		start string
+		limit int
+		keys  []string
+	}{
+		{"", -1, []string{"a", "b", "c", "d", "e"}},
+		{"c", -1, []string{"c", "d", "e"}},
+		{"bb", -1, []string{"c", "d", "e"}},
+		{"e", -1, []string{"e"}},
+		{"f", -1, []string{}},
+		{"", 2, []string{"a", "b"}},
+		{"b", 0, []string{}},
+	}
+	for _, tt := range tests {
+		if keys := ascendKeys(ki, tt.start, tt.limit); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("Ascend from %q, limit %d returned %q, want %q", tt.start, tt.limit, keys, tt.keys)
+		}
+	}
+}
+
+func TestKeyIndexRandom(t *testing.T) {
+	ki := newKeyIndex()
+	ki.rand = rand.New(rand.NewSource(1))
+	r := rand.New(rand.NewSource(2))
+	present := make(map[string]bool)
+
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(r.Intn(2000))
+		if r.Intn(3) == 0 {
+			if ok := ki.Delete(key); ok != present[key] {
+				t.Fatalf("Delete of %q returned %v, want %v", key, ok, present[key])
+			}
+			delete(present, key)
+		} else {
+			if ok := ki.Insert(key); ok == present[key] {
+				t.Fatalf("Insert of %q returned %v, want %v", key, ok, !present[key])
+			}
+			present[key] = true
+		}
+	}
+
+	want := []string{}
+	for key := range present {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	if keys := ascendKeys(ki, "", -1); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Index holds %d keys, want %d", len(keys), len(want))
+	}
+	if ki.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", ki.Len(), len(want))
+	}
+	start := "5"
+	i := sort.SearchStrings(want, start)
+	if keys := ascendKeys(ki, start, 10); !reflect.DeepEqual(keys, want[i:i+10]) {
+		t.Fatalf("Ascend from %q returned %q, want %q", start, keys, want[i:i+10])
+	}
+}
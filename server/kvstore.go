@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"log"
+	"time"
 
 	context "golang.org/x/net/context"
 
@@ -20,11 +21,35 @@ type InputChannelType struct {
 type KVStore struct {
 	C     chan InputChannelType
 	store map[string]string
+	//the keys in order for range scans, those seen through the copy-on-write layer,
+	//it is not part of the snapshot and is rebuilt from the keys when one is applied
+	keys *keyIndex
+
+	//while a snapshot is written in the background, base is the frozen content it was taken from
+	//and store only holds the changes made since then (copy-on-write), cleared is set if Clear was called since
+	//and deleted holds the keys of base deleted since
+	base    map[string]string
+	cleared bool
+	deleted map[string]bool
+
+	//client sessions by id, for at most once writes
+	sessions map[int64]*clientSession
+	//the timeout the leader gives the sessions it registers
+	sessionTimeout time.Duration
+	//the latest command timestamp applied, sessions are expired relative to it
+	lastTimestamp int64
+}
+
+// on-disk / wire form of the kv-store in a snapshot
+type kvSnapshot struct {
+	Store         map[string]string
+	Sessions      map[int64]*clientSession
+	LastTimestamp int64
 }
 
 func (s *KVStore) Get(ctx context.Context, key *pb.Key) (*pb.Result, error) {
 	// Create a channel
-	c := make(chan pb.Result)
+	c := make(chan pb.Result, 1)
 	// Create a request
 	r := pb.Command{Operation: pb.Op_GET, Arg: &pb.Command_Get{Get: key}}
 	// Send request over the channel
@@ -37,9 +62,10 @@ func (s *KVStore) Get(ctx context.Context, key *pb.Key) (*pb.Result, error) {
 
 func (s *KVStore) Set(ctx context.Context, in *pb.KeyValue) (*pb.Result, error) {
 	// Create a channel
-	c := make(chan pb.Result)
+	c := make(chan pb.Result, 1)
 	// Create a request
 	r := pb.Command{Operation: pb.Op_SET, Arg: &pb.Command_Set{Set: in}}
+	r.ClientID, r.Seq = sessionFromContext(ctx)
 	// Send request over the channel
 	s.C <- InputChannelType{command: r, response: c}
 	//log.Printf("Waiting for set response")
@@ -50,9 +76,10 @@ func (s *KVStore) Set(ctx context.Context, in *pb.KeyValue) (*pb.Result, error)
 
 func (s *KVStore) Clear(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
 	// Create a channel
-	c := make(chan pb.Result)
+	c := make(chan pb.Result, 1)
 	// Create a request
 	r := pb.Command{Operation: pb.Op_CLEAR, Arg: &pb.Command_Clear{Clear: in}}
+	r.ClientID, r.Seq = sessionFromContext(ctx)
 	// Send request over the channel
 	s.C <- InputChannelType{command: r, response: c}
 	//log.Printf("Waiting for clear response")
@@ -63,9 +90,10 @@ func (s *KVStore) Clear(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
 
 func (s *KVStore) CAS(ctx context.Context, in *pb.CASArg) (*pb.Result, error) {
 	// Create a channel
-	c := make(chan pb.Result)
+	c := make(chan pb.Result, 1)
 	// Create a request
 	r := pb.Command{Operation: pb.Op_CAS, Arg: &pb.Command_Cas{Cas: in}}
+	r.ClientID, r.Seq = sessionFromContext(ctx)
 	// Send request over the channel
 	s.C <- InputChannelType{command: r, response: c}
 	//log.Printf("Waiting for CAS response")
@@ -74,9 +102,51 @@ func (s *KVStore) CAS(ctx context.Context, in *pb.CASArg) (*pb.Result, error) {
 	return &result, nil
 }
 
+func (s *KVStore) Delete(ctx context.Context, key *pb.Key) (*pb.Result, error) {
+	// Create a channel
+	c := make(chan pb.Result, 1)
+	// Create a request
+	r := pb.Command{Operation: pb.Op_DELETE, Arg: &pb.Command_Delete{Delete: key}}
+	r.ClientID, r.Seq = sessionFromContext(ctx)
+	// Send request over the channel
+	s.C <- InputChannelType{command: r, response: c}
+	//log.Printf("Waiting for delete response")
+	result := <-c
+	return &result, nil
+}
+
+func (s *KVStore) Exists(ctx context.Context, key *pb.Key) (*pb.Result, error) {
+	// Create a channel
+	c := make(chan pb.Result, 1)
+	// Create a request
+	r := pb.Command{Operation: pb.Op_EXISTS, Arg: &pb.Command_Exists{Exists: key}}
+	// Send request over the channel
+	s.C <- InputChannelType{command: r, response: c}
+	//log.Printf("Waiting for exists response")
+	result := <-c
+	return &result, nil
+}
+
+func (s *KVStore) Range(ctx context.Context, in *pb.RangeArg) (*pb.Result, error) {
+	// Create a channel
+	c := make(chan pb.Result, 1)
+	// Create a request
+	r := pb.Command{Operation: pb.Op_RANGE, Arg: &pb.Command_Range{Range: in}}
+	// Send request over the channel
+	s.C <- InputChannelType{command: r, response: c}
+	//log.Printf("Waiting for range response")
+	result := <-c
+	return &result, nil
+}
+
+// A prefix scan is the range from the prefix up to the first key that no longer starts with it.
+func (s *KVStore) Prefix(ctx context.Context, prefix *pb.Key) (*pb.Result, error) {
+	return s.Range(ctx, &pb.RangeArg{Start: prefix.Key, End: prefixEnd(prefix.Key)})
+}
+
 func (s *KVStore) ChangeConfiguration(ctx context.Context, in *pb.Servers) (*pb.Result, error) {
 	// Create a channel
-	c := make(chan pb.Result)
+	c := make(chan pb.Result, 1)
 	// Create a request
 	r := pb.Command{Operation: pb.Op_CONFIG_CHG, Arg: &pb.Command_Servers{Servers: in}}
 	// Send request over the channel
@@ -87,62 +157,178 @@ func (s *KVStore) ChangeConfiguration(ctx context.Context, in *pb.Servers) (*pb.
 	return &result, nil
 }
 
+func (s *KVStore) TransferLeadership(ctx context.Context, in *pb.LeaderTransfer) (*pb.Result, error) {
+	// Create a channel
+	c := make(chan pb.Result, 1)
+	// Create a request
+	r := pb.Command{Operation: pb.Op_TRANSFER_LEADER, Arg: &pb.Command_Transfer{Transfer: in}}
+	// Send request over the channel
+	s.C <- InputChannelType{command: r, response: c}
+	//log.Printf("Waiting for leadership transfer response")
+	result := <-c
+	return &result, nil
+}
+
+func (s *KVStore) RegisterClient(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
+	// Create a channel
+	c := make(chan pb.Result, 1)
+	// Create a request
+	r := pb.Command{Operation: pb.Op_REGISTER_CLIENT, Arg: &pb.Command_Register{Register: in}}
+	// Send request over the channel
+	s.C <- InputChannelType{command: r, response: c}
+	//log.Printf("Waiting for register client response")
+	result := <-c
+	return &result, nil
+}
+
+func (s *KVStore) AddServer(ctx context.Context, in *pb.ServerChange) (*pb.Result, error) {
+	return s.membershipRequest(pb.Command{Operation: pb.Op_ADD_SERVER, Arg: &pb.Command_ServerChange{ServerChange: in}}), nil
+}
+
+func (s *KVStore) RemoveServer(ctx context.Context, in *pb.ServerChange) (*pb.Result, error) {
+	return s.membershipRequest(pb.Command{Operation: pb.Op_REMOVE_SERVER, Arg: &pb.Command_ServerChange{ServerChange: in}}), nil
+}
+
+func (s *KVStore) GetConfiguration(ctx context.Context, in *pb.Empty) (*pb.Result, error) {
+	return s.membershipRequest(pb.Command{Operation: pb.Op_GET_CONFIG}), nil
+}
+
+//send a membership request to the raft main loop and wait for its result
+func (s *KVStore) membershipRequest(r pb.Command) *pb.Result {
+	c := make(chan pb.Result, 1)
+	s.C <- InputChannelType{command: r, response: c}
+	result := <-c
+	return &result
+}
+
+// Whether the operation only reads the kv store, such commands may be served without being appended to the log.
+func isReadOp(op pb.Op) bool {
+	return op == pb.Op_GET || op == pb.Op_EXISTS || op == pb.Op_RANGE
+}
+
+// Used internally to generate the result of a read command, see isReadOp. Assumes no racing calls.
+func (s *KVStore) ReadInternal(c pb.Command) pb.Result {
+	switch c.Operation {
+	case pb.Op_GET:
+		return s.GetInternal(c.GetGet().Key)
+	case pb.Op_EXISTS:
+		return s.ExistsInternal(c.GetExists().Key)
+	case pb.Op_RANGE:
+		arg := c.GetRange()
+		return s.RangeInternal(arg.Start, arg.End, arg.Limit)
+	}
+	log.Fatalf("Operation %v is not a read", c.Operation)
+	return pb.Result{}
+}
+
 // Used internally to generate a result for a get request. This function assumes that it is called from a single thread of
 // execution, and hence does not handle races.
 func (s *KVStore) GetInternal(k string) pb.Result {
-	v := s.store[k]
-	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: v}}}
+	v, found := s.get(k)
+	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: v, Found: found}}}
+}
+
+// Used internally to tell whether a key is set. Assumes no racing calls.
+func (s *KVStore) ExistsInternal(k string) pb.Result {
+	_, found := s.get(k)
+	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Found: found}}}
+}
+
+// Used internally to scan the keys from start (inclusive) to end (exclusive, no bound if empty) in order,
+// at most limit of them if limit is positive. Assumes no racing calls.
+func (s *KVStore) RangeInternal(start string, end string, limit int64) pb.Result {
+	kvs := &pb.KeyValues{}
+	s.keys.Ascend(start, func(k string) bool {
+		if end != "" && k >= end {
+			return false
+		}
+		if limit > 0 && int64(len(kvs.Kvs)) == limit {
+			kvs.More = true
+			return false
+		}
+		v, _ := s.get(k)
+		kvs.Kvs = append(kvs.Kvs, &pb.KeyValue{Key: k, Value: v, Found: true})
+		return true
+	})
+	return pb.Result{Result: &pb.Result_Range{Range: kvs}}
 }
 
 // Used internally to set and generate an appropriate result. This function assumes that it is called from a single
 // thread of execution and hence does not handle race conditions.
 func (s *KVStore) SetInternal(k string, v string) pb.Result {
-	s.store[k] = v
-	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: v}}}
+	s.put(k, v)
+	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: v, Found: true}}}
+}
+
+// Used internally to delete a key, the result holds the value it had. Assumes no racing calls.
+func (s *KVStore) DeleteInternal(k string) pb.Result {
+	v, found := s.get(k)
+	if found {
+		delete(s.store, k)
+		if s.base != nil && !s.cleared {
+			s.deleted[k] = true
+		}
+		s.keys.Delete(k)
+	}
+	return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: v, Found: found}}}
 }
 
 // Used internally, this function clears a kv store. Assumes no racing calls.
 func (s *KVStore) ClearInternal() pb.Result {
 	s.store = make(map[string]string)
+	s.keys = newKeyIndex()
+	if s.base != nil {
+		s.cleared = true
+		s.deleted = make(map[string]bool)
+	}
 	return pb.Result{Result: &pb.Result_S{S: &pb.Success{}}}
 }
 
 // Used internally this function performs CAS assuming no races.
 func (s *KVStore) CasInternal(k string, v string, vn string) pb.Result {
-	vc := s.store[k]
+	//a missing key matches the empty string
+	vc, found := s.get(k)
 	if vc == v {
-		s.store[k] = vn
-		return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: vn}}}
+		s.put(k, vn)
+		return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: vn, Found: true}}}
 	} else {
-		return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: vc}}}
+		return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: k, Value: vc, Found: found}}}
 	}
 }
 
-func (s *KVStore) HandleCommand(op InputChannelType) {
+// index is the log index of the command, it becomes the session id of a client registration
+func (s *KVStore) HandleCommand(op InputChannelType, index int64) {
 	log.Printf("kv-store is handling committed command: %s", op.command.Operation)
 
 	var result pb.Result
 	var unrecognizedOp bool = false
 
+	s.expireSessions(op.command.Timestamp)
+
 	switch c := op.command; c.Operation {
-	case pb.Op_GET:
-		arg := c.GetGet()
-		result = s.GetInternal(arg.Key)
+	case pb.Op_GET, pb.Op_EXISTS, pb.Op_RANGE:
+		result = s.ReadInternal(c)
 	case pb.Op_SET:
 		arg := c.GetSet()
-		result = s.SetInternal(arg.Key, arg.Value)
+		result = s.applyWithSession(c, func() pb.Result { return s.SetInternal(arg.Key, arg.Value) })
 	case pb.Op_CLEAR:
-		result = s.ClearInternal()
+		result = s.applyWithSession(c, func() pb.Result { return s.ClearInternal() })
 	case pb.Op_CAS:
 		arg := c.GetCas()
-		result = s.CasInternal(arg.Kv.Key, arg.Kv.Value, arg.Value.Value)
+		result = s.applyWithSession(c, func() pb.Result { return s.CasInternal(arg.Kv.Key, arg.Kv.Value, arg.Value.Value) })
+	case pb.Op_DELETE:
+		arg := c.GetDelete()
+		result = s.applyWithSession(c, func() pb.Result { return s.DeleteInternal(arg.Key) })
+	case pb.Op_REGISTER_CLIENT:
+		result = s.RegisterClientInternal(index, s.lastTimestamp, time.Duration(c.SessionTimeout))
 	default:
 		// Sending a blank response to just free things up, but we don't know how to make progress here.
 		result = pb.Result{}
 		unrecognizedOp = true
 	}
 
-	//use select to do non-blocking send
+	//use select to do non-blocking send, the response channels have room for the result
+	//so it isn't lost when the command is applied before the handler waits for it (e.g. a single server)
 	select {
 	case op.response <- result:
 		log.Printf("kv-store command completed and response is sent to client.")
@@ -156,8 +342,110 @@ func (s *KVStore) HandleCommand(op InputChannelType) {
 	}
 }
 
+// Used internally to read a key through the copy-on-write layer, found is false if the key is not set.
+func (s *KVStore) get(k string) (v string, found bool) {
+	if v, ok := s.store[k]; ok || s.base == nil || s.cleared || s.deleted[k] {
+		return v, ok
+	}
+	v, found = s.base[k]
+	return v, found
+}
+
+// Used internally to write a key through the copy-on-write layer and keep the ordered keys up to date.
+func (s *KVStore) put(k string, v string) {
+	s.keys.Insert(k)
+	s.store[k] = v
+	delete(s.deleted, k)
+}
+
+// The first key after all the keys starting with the prefix, empty if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Used to freeze a point-in-time view of the kv store for a snapshot written in the background. The view must not
+// be modified, the kv store keeps the later changes aside until FinishSnapshot. Only one snapshot at a time.
+func (s *KVStore) BeginSnapshot() kvSnapshot {
+	if s.base != nil {
+		log.Fatalf("A snapshot of the kv-store is already in progress")
+	}
+	s.base = s.store
+	s.store = make(map[string]string)
+	s.cleared = false
+	s.deleted = make(map[string]bool)
+
+	//the sessions are small, a copy is enough
+	sessions := make(map[int64]*clientSession, len(s.sessions))
+	for clientID, session := range s.sessions {
+		copied := *session
+		sessions[clientID] = &copied
+	}
+	return kvSnapshot{Store: s.base, Sessions: sessions, LastTimestamp: s.lastTimestamp}
+}
+
+// Used once the background snapshot is written, to fold the changes made in the meantime back into the kv store.
+func (s *KVStore) FinishSnapshot() {
+	if s.base == nil { //the kv store was replaced by ApplySnapshot in the meantime
+		return
+	}
+	if !s.cleared {
+		for k := range s.deleted {
+			delete(s.base, k)
+		}
+		for k, v := range s.store {
+			s.base[k] = v
+		}
+		s.store = s.base
+	}
+	s.base = nil
+	s.cleared = false
+	s.deleted = nil
+}
+
+// Used to encode a view of the kv store taken by BeginSnapshot, safe to call from another goroutine.
+func encodeSnapshot(kv kvSnapshot) []byte {
+	write := new(bytes.Buffer)
+	encoder := gob.NewEncoder(write)
+	if err := encoder.Encode(kv); err != nil {
+		log.Fatalf("Could not encode the kv-store snapshot: %v", err)
+	}
+	return write.Bytes()
+}
+
+// Used to replace the whole kv store by the given snapshot, it does not merge with the current content.
 func (s *KVStore) ApplySnapshot(snapshot []byte) {
-	data := bytes.NewBuffer(snapshot)
-	decoder := gob.NewDecoder(data)
-	decoder.Decode(&s.store)
+	//an empty snapshot is an empty kv store
+	var kv kvSnapshot
+	if len(snapshot) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(snapshot)).Decode(&kv); err != nil {
+			//snapshots taken before sessions were added only have the plain map
+			kv = kvSnapshot{Store: make(map[string]string)}
+			if err := gob.NewDecoder(bytes.NewBuffer(snapshot)).Decode(&kv.Store); err != nil {
+				log.Fatalf("Could not decode the kv-store snapshot: %v", err)
+			}
+		}
+	}
+	if kv.Store == nil {
+		kv.Store = make(map[string]string)
+	}
+	if kv.Sessions == nil {
+		kv.Sessions = make(map[int64]*clientSession)
+	}
+	s.store = kv.Store
+	s.base = nil
+	s.cleared = false
+	s.deleted = nil
+	s.keys = newKeyIndex()
+	for k := range kv.Store {
+		s.keys.Insert(k)
+	}
+	s.sessions = kv.Sessions
+	s.lastTimestamp = kv.LastTimestamp
 }
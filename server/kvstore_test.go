@@ -0,0 +1,255 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	"github.com/raft/pb"
+)
+
+func newTestKVStore(content map[string]string) *KVStore {
+	s := &KVStore{store: make(map[string]string), keys: newKeyIndex(), sessions: make(map[int64]*clientSession)}
+	for k, v := range content {
+		s.SetInternal(k, v)
+	}
+	return s
+}
+
+//the content of the kv store as seen through the copy-on-write layer, from a range scan of all the keys
+func kvContent(s *KVStore) map[string]string {
+	content := make(map[string]string)
+	result := s.RangeInternal("", "", 0)
+	for _, kv := range result.GetRange().Kvs {
+		content[kv.Key] = kv.Value
+	}
+	return content
+}
+
+func TestKVStoreDuringSnapshot(t *testing.T) {
+	initial := map[string]string{"a": "1", "b": "2", "c": "3"}
+
+	tests := []struct {
+		name    string
+		apply   func(s *KVStore)
+		content map[string]string
+	}{
+		{"nothing", func(s *KVStore) {}, initial},
+		{"set", func(s *KVStore) {
+			s.SetInternal("b", "20")
+			s.SetInternal("d", "4")
+		}, map[string]string{"a": "1", "b": "20", "c": "3", "d": "4"}},
+		{"delete", func(s *KVStore) {
+			s.DeleteInternal("a")
+			s.DeleteInternal("missing")
+		}, map[string]string{"b": "2", "c": "3"}},
+		{"delete then set", func(s *KVStore) {
+			s.DeleteInternal("a")
+			s.SetInternal("a", "10")
+		}, map[string]string{"a": "10", "b": "2", "c": "3"}},
+		{"set then delete", func(s *KVStore) {
+			s.SetInternal("d", "4")
+			s.DeleteInternal("d")
+			s.DeleteInternal("c")
+		}, map[string]string{"a": "1", "b": "2"}},
+		{"clear", func(s *KVStore) {
+			s.ClearInternal()
+		}, map[string]string{}},
+		{"clear then set", func(s *KVStore) {
+			s.ClearInternal()
+			s.SetInternal("b", "20")
+		}, map[string]string{"b": "20"}},
+		{"set then clear", func(s *KVStore) {
+			s.SetInternal("d", "4")
+			s.ClearInternal()
+			s.SetInternal("e", "5")
+			s.DeleteInternal("e")
+		}, map[string]string{}},
+		{"cas", func(s *KVStore) {
+			s.CasInternal("a", "1", "10")
+			s.CasInternal("b", "wrong", "20")
+			s.CasInternal("d", "", "4")
+		}, map[string]string{"a": "10", "b": "2", "c": "3", "d": "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestKVStore(initial)
+			view := s.BeginSnapshot()
+			tt.apply(s)
+
+			//the reads see the changes while the snapshot keeps the content it was taken from
+			if content := kvContent(s); !reflect.DeepEqual(content, tt.content) {
+				t.Fatalf("Content during the snapshot %v, want %v", content, tt.content)
+			}
+			for k, v := range tt.content {
+				if got, found := s.get(k); !found || got != v {
+					t.Fatalf("Get %q during the snapshot returned %q, %v, want %q", k, got, found, v)
+				}
+			}
+			for k := range initial {
+				if _, ok := tt.content[k]; !ok {
+					if _, found := s.get(k); found {
+						t.Fatalf("Key %q should be deleted during the snapshot", k)
+					}
+				}
+			}
+			if !reflect.DeepEqual(view.Store, initial) {
+				t.Fatalf("Snapshot content %v, want %v", view.Store, initial)
+			}
+
+			applied := newTestKVStore(nil)
+			applied.ApplySnapshot(encodeSnapshot(view))
+			if content := kvContent(applied); !reflect.DeepEqual(content, initial) {
+				t.Fatalf("Applied snapshot content %v, want %v", content, initial)
+			}
+
+			s.FinishSnapshot()
+			if !reflect.DeepEqual(s.store, tt.content) {
+				t.Fatalf("Content after the snapshot %v, want %v", s.store, tt.content)
+			}
+			if content := kvContent(s); !reflect.DeepEqual(content, tt.content) {
+				t.Fatalf("Scanned content after the snapshot %v, want %v", content, tt.content)
+			}
+
+			//a second snapshot starts from the folded content
+			if view := s.BeginSnapshot(); !reflect.DeepEqual(view.Store, tt.content) {
+				t.Fatalf("Next snapshot content %v, want %v", view.Store, tt.content)
+			}
+			s.FinishSnapshot()
+		})
+	}
+}
+
+func TestKVStoreApplySnapshotDuringSnapshot(t *testing.T) {
+	s := newTestKVStore(map[string]string{"a": "1"})
+	s.BeginSnapshot()
+	s.SetInternal("b", "2")
+
+	//a snapshot installed from the leader replaces everything, including the changes kept aside
+	installed := newTestKVStore(map[string]string{"c": "3"})
+	s.ApplySnapshot(encodeSnapshot(installed.BeginSnapshot()))
+	s.FinishSnapshot()
+
+	want := map[string]string{"c": "3"}
+	if !reflect.DeepEqual(s.store, want) {
+		t.Fatalf("Content after the snapshot %v, want %v", s.store, want)
+	}
+	if content := kvContent(s); !reflect.DeepEqual(content, want) {
+		t.Fatalf("Scanned content after the snapshot %v, want %v", content, want)
+	}
+}
+
+func rangeKeys(result *pb.Result) ([]string, bool) {
+	keys := []string{}
+	for _, kv := range result.GetRange().Kvs {
+		keys = append(keys, kv.Key)
+	}
+	return keys, result.GetRange().More
+}
+
+func TestKVStoreRange(t *testing.T) {
+	s := newTestKVStore(map[string]string{"a": "1", "ab": "2", "abc": "3", "abd": "4", "b": "5", "b\xff": "6", "c": "7"})
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		limit int64
+		keys  []string
+		more  bool
+	}{
+		{"everything", "", "", 0, []string{"a", "ab", "abc", "abd", "b", "b\xff", "c"}, false},
+		{"from start", "abd", "", 0, []string{"abd", "b", "b\xff", "c"}, false},
+		{"start between keys", "aa", "", 0, []string{"ab", "abc", "abd", "b", "b\xff", "c"}, false},
+		{"end exclusive", "a", "abd", 0, []string{"a", "ab", "abc"}, false},
+		{"empty range", "abe", "b", 0, []string{}, false},
+		{"start after the last key", "d", "", 0, []string{}, false},
+		{"limit", "", "", 2, []string{"a", "ab"}, true},
+		{"limit within end", "a", "abd", 2, []string{"a", "ab"}, true},
+		//the end is reached right after the limit, there is nothing more
+		{"limit equal to the range", "a", "abd", 3, []string{"a", "ab", "abc"}, false},
+		{"limit equal to the rest", "b", "", 3, []string{"b", "b\xff", "c"}, false},
+		{"limit beyond the range", "a", "abd", 10, []string{"a", "ab", "abc"}, false},
+		{"prefix", "ab", prefixEnd("ab"), 0, []string{"ab", "abc", "abd"}, false},
+		{"prefix with limit", "ab", prefixEnd("ab"), 2, []string{"ab", "abc"}, true},
+		{"prefix ending in 0xff", "b\xff", prefixEnd("b\xff"), 0, []string{"b\xff"}, false},
+		{"prefix without keys", "abx", prefixEnd("abx"), 1, []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := s.RangeInternal(tt.start, tt.end, tt.limit)
+			keys, more := rangeKeys(&result)
+			if !reflect.DeepEqual(keys, tt.keys) || more != tt.more {
+				t.Fatalf("Got keys %q, more: %v, want keys %q, more: %v", keys, more, tt.keys, tt.more)
+			}
+		})
+	}
+
+	//the next page starts right after the last key returned
+	var keys []string
+	start := ""
+	for {
+		result := s.RangeInternal(start, "", 3)
+		page, more := rangeKeys(&result)
+		keys = append(keys, page...)
+		if !more {
+			break
+		}
+		start = page[len(page)-1] + "\x00"
+	}
+	if want := []string{"a", "ab", "abc", "abd", "b", "b\xff", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Paged keys %q, want %q", keys, want)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		end    string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"ab", "ac"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"\xff", ""},
+		{"\xff\xff", ""},
+	}
+	for _, tt := range tests {
+		if end := prefixEnd(tt.prefix); end != tt.end {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, end, tt.end)
+		}
+	}
+}
+
+func TestKVStoreRangeAndPrefix(t *testing.T) {
+	s := newTestKVStore(map[string]string{"user/1": "a", "user/2": "b", "users": "c", "v": "d"})
+	s.C = make(chan InputChannelType)
+	//serve the reads as the main loop does
+	go func() {
+		for op := range s.C {
+			op.response <- s.ReadInternal(op.command)
+		}
+	}()
+	defer close(s.C)
+
+	result, err := s.Prefix(context.Background(), &pb.Key{Key: "user/"})
+	if err != nil {
+		t.Fatalf("Prefix failed %v", err)
+	}
+	if keys, more := rangeKeys(result); !reflect.DeepEqual(keys, []string{"user/1", "user/2"}) || more {
+		t.Fatalf("Prefix returned %q, more: %v", keys, more)
+	}
+
+	result, err = s.Range(context.Background(), &pb.RangeArg{Start: "user/2", Limit: 2})
+	if err != nil {
+		t.Fatalf("Range failed %v", err)
+	}
+	if keys, more := rangeKeys(result); !reflect.DeepEqual(keys, []string{"user/2", "users"}) || !more {
+		t.Fatalf("Range returned %q, more: %v", keys, more)
+	}
+	if kv := result.GetRange().Kvs[1]; kv.Value != "c" || !kv.Found {
+		t.Fatalf("Range returned %v for users", kv)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+	Learners (non-voting members, section 4.2.1 of Diego's dissertation).
+
+	A configuration change that adds servers first adds them as learners: they receive AppendEntries and
+	InstallSnapshot like any follower, but they don't vote, don't campaign and don't count toward the quorum.
+	Once the config entry adding them is committed and the matchIndex of every learner covers that entry and
+	is within -learner-catch-up entries of the leader's last log index, the leader promotes them by appending
+	the joint configuration of the change, which then carries on as before. An empty server joining the
+	cluster thus can't stall commits while it catches up.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/raft/pb"
+)
+
+//the first config entry of a change to the client's new list: the servers it adds join as learners first,
+//a change adding no server goes straight to the joint configuration
+func (r *Raft) newConfigChange(req *pb.Servers) *pb.Servers {
+	var added []string
+	for _, server := range strings.Split(req.NewList, ",") {
+		if server != "" && !r.isPeer(server) {
+			added = append(added, server)
+		}
+	}
+	if len(added) == 0 {
+		return &pb.Servers{CurrList: req.CurrList, NewList: req.NewList, Members: req.Members}
+	}
+	return &pb.Servers{CurrList: req.CurrList, Learners: strings.Join(added, ","), TargetList: req.NewList,
+		Members: req.Members}
+}
+
+//whether the latest config entry adds learners, such a change may be superseded by a new one
+func (r *Raft) learnersCatchingUp() bool {
+	servers, ok := r.configEntryAt(r.configurations.lastConfigLogIndex)
+	return ok && servers.GetLearners() != ""
+}
+
+//whether the client of the config entry at index waits for learners to be promoted
+func (r *Raft) awaitingPromotion(index int64) bool {
+	return index == r.configurations.lastConfigLogIndex && r.learnersCatchingUp()
+}
+
+//fail the client of a change whose learners are still catching up, a new change replaces it
+func (r *Raft) abortLearnerChange() {
+	index := r.configurations.lastConfigLogIndex
+	if responseChan, ok := r.clientsResponse[index]; ok {
+		//use select to do non-blocking send
+		select {
+		case responseChan <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "Superseded by a new change configurations request."}}}:
+		default:
+		}
+		delete(r.clientsResponse, index)
+	}
+}
+
+//once the config entry adding the learners is committed and they have caught up, the leader appends the joint
+//configuration of the change; returns whether it did
+func (r *Raft) maybePromoteLearners() bool {
+	index := r.configurations.lastConfigLogIndex
+	servers, ok := r.configEntryAt(index)
+	if r.state != leader || !ok || servers.GetLearners() == "" || index > r.lastApplied {
+		return false
+	}
+	//a learner has at least the entry adding it, even when the log is shorter than the catch-up threshold
+	caughtUp := max(r.getLastLogIndex()-r.opts.learnerCatchUp, index)
+	for _, learner := range *r.configurations.config.learners {
+		if r.matchIndex[learner] < caughtUp {
+			return false
+		}
+	}
+
+	log.Printf("Learners %s caught up, promoting them with the joint configuration.", servers.Learners)
+	r.appendConfigEntry(&pb.Servers{CurrList: servers.CurrList, NewList: servers.TargetList}, index)
+	return true
+}
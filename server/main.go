@@ -7,6 +7,7 @@ import (
 	rand "math/rand"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/raft/pb"
@@ -20,15 +21,92 @@ func main() {
 	var peers arrayPeers
 	var clientPort int
 	var raftPort int
+	var opts Options
+	var readMode string
+	var clockDrift int
+	var sessionTimeout int
+	var maxBatchWait int
+	var snapshotInterval int
+	var requestedID string
+	var requestedClusterID string
+	var join string
 	flag.Int64Var(&seed, "seed", -1,
 		"Seed for random number generator, values less than 0 result in use of time")
 	flag.IntVar(&clientPort, "port", 3000,
 		"Port on which server should listen to client requests")
 	flag.IntVar(&raftPort, "raft", 3001,
 		"Port on which server should listen to Raft requests")
-	flag.Var(&peers, "peer", "A peer for this process")
+	flag.Var(&peers, "peer", "A server of the initial configuration with -bootstrap, as id=raft-address, or its raft address alone which is then its id as well")
+	flag.BoolVar(&opts.bootstrap, "bootstrap", false,
+		"Form a new cluster of this server and the -peer servers, only used on the first start with the data directory")
+	flag.StringVar(&join, "join", "",
+		"Comma separated client endpoints of an existing cluster to ask to add this server, only used until it is added")
+	flag.StringVar(&requestedID, "id", "",
+		"ID of this server, only used on its first start with the data directory, its raft address if empty (as a -peer given by its address alone)")
+	flag.StringVar(&requestedClusterID, "cluster-id", "",
+		"ID of the cluster, only used on the first start with the data directory. If empty, a server bootstrapping alone generates one and joining servers adopt their leader's")
+	flag.StringVar(&opts.raftAddress, "raft-address", "",
+		"Address the other servers reach this server's Raft service at, hostname:raft-port if empty")
+	flag.StringVar(&opts.clientAddress, "client-address", "",
+		"Address clients reach this server's kv-store service at, hostname:port if empty")
+	flag.StringVar(&opts.dataDir, "data", "/data",
+		"Directory in which the Raft states and snapshots are persisted")
+	flag.StringVar(&readMode, "read", "read-index",
+		"How GET requests are served: log (replicated as a log entry), read-index or lease")
+	flag.IntVar(&clockDrift, "clock-drift", CLOCK_DRIFT_BOUND,
+		"Bound of clock drift between servers in ms, the leader lease is shortened by it (only used by -read lease)")
+	flag.IntVar(&opts.maxAppendEntries, "max-append-entries", MAX_APPEND_ENTRIES,
+		"Maximum number of log entries sent in one AppendEntries request")
+	flag.IntVar(&opts.maxAppendBytes, "max-append-bytes", MAX_APPEND_BYTES,
+		"Maximum size in bytes of the log entries sent in one AppendEntries request (at least one entry is sent)")
+	flag.IntVar(&opts.maxInflight, "max-inflight", MAX_INFLIGHT,
+		"Maximum number of AppendEntries requests in flight to each peer")
+	flag.IntVar(&opts.maxBatch, "max-batch", MAX_BATCH,
+		"Maximum number of client requests appended to the log together")
+	flag.IntVar(&maxBatchWait, "max-batch-wait", MAX_BATCH_WAIT,
+		"Time in ms to wait for more client requests to join a batch, 0 only batches the requests already waiting")
+	flag.IntVar(&sessionTimeout, "session-timeout", DEFAULT_SESSION_TIMEOUT,
+		"Seconds after which an idle client session registered while this server is the leader expires")
+	flag.Int64Var(&opts.snapshotEntries, "snapshot-entries", SNAPSHOT_ENTRIES,
+		"Take a snapshot once this many log entries were applied since the last one, 0 disables this trigger")
+	flag.IntVar(&opts.snapshotBytes, "snapshot-bytes", SNAPSHOT_BYTES,
+		"Take a snapshot once this many bytes were appended to the persisted log since the last one, 0 disables this trigger")
+	flag.IntVar(&snapshotInterval, "snapshot-interval", SNAPSHOT_INTERVAL,
+		"Take a snapshot once this many seconds passed since the last one and entries were applied, 0 disables this trigger")
+	flag.Int64Var(&opts.snapshotTrailing, "snapshot-trailing", SNAPSHOT_TRAILING,
+		"Number of log entries kept before the snapshot, so that slightly lagging followers don't need the snapshot")
+	flag.Int64Var(&opts.learnerCatchUp, "learner-catch-up", LEARNER_CATCH_UP,
+		"Number of log entries a new server may lag behind the leader to be promoted from learner to voter")
 	flag.Parse()
 
+	opts.clockDrift = time.Duration(clockDrift) * time.Millisecond
+	opts.maxBatchWait = time.Duration(maxBatchWait) * time.Millisecond
+	opts.snapshotInterval = time.Duration(snapshotInterval) * time.Second
+	if mode, err := parseReadMode(readMode); err != nil {
+		log.Fatalf("%v", err)
+	} else {
+		opts.readMode = mode
+	}
+	if opts.readMode == readModeLease && opts.clockDrift >= ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond {
+		log.Fatalf("Clock drift bound must be less than the minimum election timeout %dms", ELECTION_TIMEOUT_LOWER_BOUND)
+	}
+
+	if opts.maxAppendEntries < 1 || opts.maxAppendBytes < 1 || opts.maxInflight < 1 || opts.maxBatch < 1 {
+		log.Fatalf("-max-append-entries, -max-append-bytes, -max-inflight and -max-batch must be at least 1")
+	}
+	if opts.learnerCatchUp < 0 {
+		log.Fatalf("-learner-catch-up can't be negative")
+	}
+	if opts.snapshotEntries < 0 || opts.snapshotBytes < 0 || opts.snapshotInterval < 0 || opts.snapshotTrailing < 0 {
+		log.Fatalf("-snapshot-entries, -snapshot-bytes, -snapshot-interval and -snapshot-trailing can't be negative")
+	}
+	if join != "" {
+		if opts.bootstrap {
+			log.Fatalf("-bootstrap and -join can't be used together")
+		}
+		opts.join = strings.Split(join, ",")
+	}
+
 	// Initialize the random number generator
 	if seed < 0 {
 		r = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -43,8 +121,45 @@ func main() {
 		log.Fatalf("Could not get hostname")
 	}
 
-	id := fmt.Sprintf("%s:%d", name, raftPort)
-	log.Printf("Starting peer with ID %s", id)
+	if opts.raftAddress == "" {
+		opts.raftAddress = fmt.Sprintf("%s:%d", name, raftPort)
+	}
+	if opts.clientAddress == "" {
+		opts.clientAddress = fmt.Sprintf("%s:%d", name, clientPort)
+	}
+
+	if strings.ContainsAny(requestedID, ",=") {
+		log.Fatalf("-id can't contain ',' or '='")
+	}
+	//a -peer given by its raft address alone has that address as its id, so it is our default one too
+	id, err := LoadNodeID(opts.dataDir, requestedID, opts.raftAddress)
+	if err != nil {
+		log.Fatalf("Could not load the server ID: %v", err)
+	}
+	log.Printf("Starting peer with ID %s, raft address: %s, client address: %s", id, opts.raftAddress, opts.clientAddress)
+
+	//the servers are identified by their ids, the -peer flags also give their raft addresses
+	var peerIDs arrayPeers
+	opts.peerAddresses = make(map[string]string)
+	for _, peer := range peers {
+		peerID, address := parsePeer(peer)
+		if peerID == "" || strings.ContainsAny(peerID, ",") || address == "" {
+			log.Fatalf("Invalid -peer %q", peer)
+		}
+		peerIDs.Set(peerID)
+		opts.peerAddresses[peerID] = address
+	}
+
+	//a server bootstrapping a cluster alone generates its id, the servers bootstrapping one together share a given id
+	opts.clusterID, err = LoadClusterID(opts.dataDir, requestedClusterID, opts.bootstrap && len(peerIDs) == 0)
+	if err != nil {
+		log.Fatalf("Could not load the cluster ID: %v", err)
+	}
+	if opts.clusterID != "" {
+		log.Printf("Member of cluster %s", opts.clusterID)
+	} else {
+		log.Printf("The cluster ID is not known yet, it is adopted from the leader")
+	}
 
 	// Convert port to a string form
 	portString := fmt.Sprintf(":%d", clientPort)
@@ -58,8 +173,9 @@ func main() {
 	s := grpc.NewServer()
 
 	// Initialize KVStore
-	store := KVStore{C: make(chan InputChannelType), store: make(map[string]string)}
-	go serve(&store, r, &peers, id, raftPort)
+	store := KVStore{C: make(chan InputChannelType), store: make(map[string]string), keys: newKeyIndex(),
+		sessions: make(map[int64]*clientSession), sessionTimeout: time.Duration(sessionTimeout) * time.Second}
+	go serve(&store, r, &peerIDs, id, raftPort, opts)
 
 	// Tell GRPC that s will be serving requests for the KvStore service and should use store (defined on line 23)
 	// as the struct whose methods should be called in response.
@@ -0,0 +1,109 @@
+/*
+	Node IDs and addresses.
+
+	A server is identified by an ID generated on its first start (or given with -id) and persisted in its data
+	directory, so it stays the same member when it moves to another host or port. Config entries map the IDs of
+	their servers to the addresses of their Raft and kv-store services: peers are dialed at the recorded Raft
+	address and redirects send clients to the recorded client address of the leader. A server missing from the
+	address list, e.g. a -peer given without an id, is reached at its id.
+
+	A leader records its own addresses with a config entry keeping the same servers when they differ from the
+	recorded ones, e.g. after it moved; an AddServer request for a server already in the configuration updates
+	its addresses the same way.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
+)
+
+//a -peer flag is either id=address or the address alone, which is then the id as well
+func parsePeer(peer string) (string, string) {
+	if i := strings.Index(peer, "="); i >= 0 {
+		return peer[:i], peer[i+1:]
+	}
+	return peer, peer
+}
+
+//the addresses of this server
+func (r *Raft) ownMember() *pb.Member {
+	return &pb.Member{Id: r.me, RaftAddress: r.opts.raftAddress, ClientAddress: r.opts.clientAddress}
+}
+
+//the addresses recorded for the server in the config entry
+func recordedMember(servers *pb.Servers, id string) (*pb.Member, bool) {
+	for _, member := range servers.GetMembers() {
+		if member.Id == id {
+			return member, true
+		}
+	}
+	return nil, false
+}
+
+//the addresses of the server as recorded in the latest configuration
+func (r *Raft) memberAddresses(id string) *pb.Member {
+	if servers, ok := r.configEntryAt(r.configurations.lastConfigLogIndex); ok {
+		if member, ok := recordedMember(servers, id); ok {
+			return member
+		}
+	}
+	if id == r.me {
+		return r.ownMember()
+	}
+	return &pb.Member{Id: id, RaftAddress: id}
+}
+
+//fill in the addresses of the servers of a new config entry from the latest configuration,
+//the addresses it already records are kept
+func (r *Raft) withMembers(servers *pb.Servers) *pb.Servers {
+	recorded := make(map[string]bool)
+	for _, member := range servers.Members {
+		recorded[member.Id] = true
+	}
+	for _, list := range []string{servers.CurrList, servers.NewList, servers.Learners, servers.TargetList} {
+		for _, id := range strings.Split(list, ",") {
+			if id != "" && !recorded[id] {
+				servers.Members = append(servers.Members, r.memberAddresses(id))
+				recorded[id] = true
+			}
+		}
+	}
+	return servers
+}
+
+//the server with the given raft address other than the given one, if any
+func (r *Raft) memberAt(address string, except string) (string, bool) {
+	for _, id := range *r.getMembers() {
+		if id != except && r.memberAddresses(id).RaftAddress == address {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+//a leader whose addresses differ from the recorded ones records them, the config entry keeps the same servers
+//so it needs no joint configuration; the startup configuration (index 0) is never replicated, each server
+//only knows its own client address there
+func (r *Raft) maybeRecordOwnAddresses() {
+	if r.state != leader || !r.configurations.stable || r.transfer != nil || !r.isPeer(r.me) {
+		return
+	}
+	servers, ok := r.configEntryAt(r.configurations.lastConfigLogIndex)
+	if !ok {
+		return
+	}
+	own := r.ownMember()
+	if recorded, ok := recordedMember(servers, r.me); ok && proto.Equal(recorded, own) && r.configurations.lastConfigLogIndex > 0 {
+		return
+	}
+
+	log.Printf("Recording the addresses of %s in the configuration, raft: %s, client: %s.",
+		r.me, own.RaftAddress, own.ClientAddress)
+	r.appendConfigEntry(&pb.Servers{CurrList: servers.CurrList, Members: []*pb.Member{own}}, 0)
+}
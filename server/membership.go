@@ -0,0 +1,109 @@
+/*
+	Single server membership requests.
+
+	AddServer and RemoveServer name one server only, the leader computes the new list from its latest
+	configuration and carries the change out like a ChangeConfiguration request, so operators don't race
+	each other rewriting the whole list. GetConfiguration exposes the index of the config entry of the
+	leader's latest configuration, which the requests may give as expectedConfigIndex to only apply to it.
+	AddServer for a server already in the configuration updates its addresses.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
+)
+
+const alreadyMemberMsg = "The server is already in the configuration."
+
+//turn an AddServer / RemoveServer request into the change of the voting servers it asks for,
+//returns a failure message instead if it doesn't apply to the current configuration
+func (r *Raft) membershipChange(op pb.Op, change *pb.ServerChange) (*pb.Servers, string) {
+	if change.ExpectedConfigIndex != 0 && change.ExpectedConfigIndex != r.configurations.lastConfigLogIndex {
+		return nil, fmt.Sprintf("The configuration index is %d, not the expected %d.",
+			r.configurations.lastConfigLogIndex, change.ExpectedConfigIndex)
+	}
+	if change.Id == "" || strings.ContainsAny(change.Id, ",=") {
+		return nil, "Invalid server id."
+	}
+	member := &pb.Member{Id: change.Id, RaftAddress: change.Address, ClientAddress: change.ClientAddress}
+	if member.RaftAddress == "" {
+		member.RaftAddress = change.Id
+	}
+	if other, ok := r.memberAt(member.RaftAddress, change.Id); ok && op == pb.Op_ADD_SERVER {
+		return nil, fmt.Sprintf("The address %s is used by server %s.", member.RaftAddress, other)
+	}
+
+	voters := r.getServerList()
+	if op == pb.Op_REMOVE_SERVER && r.learnersCatchingUp() && r.configurations.config.learners.Contains(change.Id) {
+		//removing a learner that is still catching up replaces the pending change with one without it
+		servers, _ := r.configEntryAt(r.configurations.lastConfigLogIndex)
+		var target []string
+		for _, server := range strings.Split(servers.TargetList, ",") {
+			if server != change.Id {
+				target = append(target, server)
+			}
+		}
+		return &pb.Servers{CurrList: voters.String(), NewList: strings.Join(target, ",")}, ""
+	}
+	if !r.configurations.stable {
+		return nil, "There is already a pending change configurations request."
+	}
+
+	var newList []string
+	switch op {
+	case pb.Op_ADD_SERVER:
+		if voters.Contains(change.Id) {
+			//an address update, the recorded addresses are kept unless new ones are given
+			recorded := r.memberAddresses(change.Id)
+			if change.Address == "" {
+				member.RaftAddress = recorded.RaftAddress
+			}
+			if member.ClientAddress == "" {
+				member.ClientAddress = recorded.ClientAddress
+			}
+			if proto.Equal(member, recorded) {
+				return nil, alreadyMemberMsg
+			}
+			return &pb.Servers{CurrList: voters.String(), Members: []*pb.Member{member}}, ""
+		}
+		newList = append(append(newList, *voters...), change.Id)
+	case pb.Op_REMOVE_SERVER:
+		if !voters.Contains(change.Id) {
+			return nil, "The server is not in the configuration."
+		}
+		for _, server := range *voters {
+			if server != change.Id {
+				newList = append(newList, server)
+			}
+		}
+		if len(newList) == 0 {
+			return nil, "Can't remove the last server of the configuration."
+		}
+	}
+	servers := &pb.Servers{CurrList: voters.String(), NewList: strings.Join(newList, ",")}
+	if op == pb.Op_ADD_SERVER {
+		servers.Members = []*pb.Member{member}
+	}
+	return servers, ""
+}
+
+//the leader's latest configuration, committed or not
+func (r *Raft) configurationResult() pb.Result {
+	config := &pb.Configuration{
+		Servers: r.getServerList().String(),
+		Index:   r.configurations.lastConfigLogIndex,
+		Pending: !r.configurations.stable}
+	if learners := r.configurations.config.learners; learners != nil {
+		config.Learners = learners.String()
+	}
+	for _, id := range *r.getMembers() {
+		config.Members = append(config.Members, r.memberAddresses(id))
+	}
+	return pb.Result{Result: &pb.Result_Configuration{Configuration: config}}
+}
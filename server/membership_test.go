@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
+)
+
+func testMember(id string) *pb.Member {
+	return &pb.Member{Id: id, RaftAddress: id + ":3001", ClientAddress: id + ":4001"}
+}
+
+//a server whose latest config entry, at index 1, is servers
+func raftWithConfig(t *testing.T, servers *pb.Servers) *Raft {
+	r := &Raft{me: "s1", persister: MakePersister(t.TempDir())}
+	t.Cleanup(func() { r.persister.wal.Close() })
+	initial := &pb.Servers{CurrList: "s1", Members: []*pb.Member{testMember("s1")}}
+	for i, config := range []*pb.Servers{initial, servers} {
+		r.log = append(r.log, &pb.Entry{Index: int64(i), Term: 1,
+			Cmd: &pb.Command{Operation: pb.Op_CONFIG_CHG, Arg: &pb.Command_Servers{Servers: config}}})
+	}
+	r.configurations.lastConfigLogIndex = 1
+	r.configurations.stable = isStableConfig(servers)
+	r.updateConfiguration()
+	return r
+}
+
+func TestMembershipChange(t *testing.T) {
+	stable := &pb.Servers{CurrList: "s1,s2,s3", Members: []*pb.Member{testMember("s1"), testMember("s2"), testMember("s3")}}
+	joint := &pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s2,s3,s4",
+		Members: []*pb.Member{testMember("s1"), testMember("s2"), testMember("s3"), testMember("s4")}}
+	catchingUp := &pb.Servers{CurrList: "s1,s2,s3", Learners: "s4", TargetList: "s1,s2,s3,s4",
+		Members: []*pb.Member{testMember("s1"), testMember("s2"), testMember("s3"), testMember("s4")}}
+	single := &pb.Servers{CurrList: "s1", Members: []*pb.Member{testMember("s1")}}
+
+	tests := []struct {
+		name    string
+		config  *pb.Servers
+		op      pb.Op
+		change  *pb.ServerChange
+		servers *pb.Servers
+		failure string
+	}{
+		{"add", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4", Address: "s4:3001"},
+			&pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s2,s3,s4", Members: []*pb.Member{{Id: "s4", RaftAddress: "s4:3001"}}}, ""},
+		{"add without an address", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4"},
+			&pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s2,s3,s4", Members: []*pb.Member{{Id: "s4", RaftAddress: "s4"}}}, ""},
+		{"remove", stable, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s2"},
+			&pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s3"}, ""},
+		{"expected config index", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4", ExpectedConfigIndex: 1},
+			&pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s2,s3,s4", Members: []*pb.Member{{Id: "s4", RaftAddress: "s4"}}}, ""},
+		{"other config index", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4", ExpectedConfigIndex: 2},
+			nil, "The configuration index is 1, not the expected 2."},
+		{"empty id", stable, pb.Op_ADD_SERVER, &pb.ServerChange{}, nil, "Invalid server id."},
+		{"id with a comma", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4,s5"}, nil, "Invalid server id."},
+		{"address of another server", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s4", Address: "s2:3001"},
+			nil, "The address s2:3001 is used by server s2."},
+		{"already a member", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s2", Address: "s2:3001"}, nil, alreadyMemberMsg},
+		{"already a member, no address given", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s2"}, nil, alreadyMemberMsg},
+		//the servers stay the same, no joint configuration is needed
+		{"new client address", stable, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s2", ClientAddress: "other:4001"},
+			&pb.Servers{CurrList: "s1,s2,s3", Members: []*pb.Member{{Id: "s2", RaftAddress: "s2:3001", ClientAddress: "other:4001"}}}, ""},
+		{"remove a server not in the configuration", stable, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s4"},
+			nil, "The server is not in the configuration."},
+		{"remove the last server", single, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s1"},
+			nil, "Can't remove the last server of the configuration."},
+		//one change at a time
+		{"add during a joint configuration", joint, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s5"},
+			nil, "There is already a pending change configurations request."},
+		{"remove during a joint configuration", joint, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s2"},
+			nil, "There is already a pending change configurations request."},
+		{"add while learners catch up", catchingUp, pb.Op_ADD_SERVER, &pb.ServerChange{Id: "s5"},
+			nil, "There is already a pending change configurations request."},
+		{"remove a voter while learners catch up", catchingUp, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s2"},
+			nil, "There is already a pending change configurations request."},
+		{"remove a learner catching up", catchingUp, pb.Op_REMOVE_SERVER, &pb.ServerChange{Id: "s4"},
+			&pb.Servers{CurrList: "s1,s2,s3", NewList: "s1,s2,s3"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := raftWithConfig(t, tt.config)
+			servers, failure := r.membershipChange(tt.op, tt.change)
+			if failure != tt.failure {
+				t.Fatalf("Got failure %q, want %q", failure, tt.failure)
+			}
+			if !proto.Equal(servers, tt.servers) {
+				t.Fatalf("Got change %v, want %v", servers, tt.servers)
+			}
+		})
+	}
+}
@@ -1,49 +1,465 @@
 /*
 	Author: ywn202@nyu.edu
 	Support Raft to save persistent states.
+
+	The states are kept under a data directory so that they survive a restart:
+	  raft-meta  currentTerm / votedFor, replaced atomically whenever they change
+	  raft-wal   append-only write-ahead log of the log entries
+	  snapshot   the latest snapshot of the kv-store with its metadata, replaced atomically
+	  node-id    the id of the server, written on its first start
+	  cluster-id the id of the cluster the server belongs to, written once it is known
 */
 
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
 )
 
+const (
+	metaFileName      = "raft-meta"
+	walFileName       = "raft-wal"
+	snapshotFileName  = "snapshot"
+	nodeIDFileName    = "node-id"
+	clusterIDFileName = "cluster-id"
+	//a snapshot being received from the leader
+	incomingSnapshotFileName = "snapshot.incoming"
+
+	//each wal record is framed by its payload length and crc32 checksum
+	walHeaderSize = 8
+)
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+// the persistent states other than the log entries
+type RaftMeta struct {
+	CurrentTerm  int64
+	VotedFor     string
+	LastVoteTerm int64
+}
+
+// one record of the write-ahead log.
+// entries with index >= TruncateFrom are dropped before Entries are appended,
+// a record with TruncateFrom == 0 is a pure append.
+type walRecord struct {
+	TruncateFrom int64
+	Entries      []*pb.Entry
+}
+
+// on-disk form of walRecord, entries are kept in their protobuf encoding
+type walRecordData struct {
+	TruncateFrom int64
+	Entries      [][]byte
+}
+
+// the metadata saved along with a snapshot
+type SnapshotMeta struct {
+	//the last log entry included in the snapshot
+	LastIncludedIndex int64
+	LastIncludedTerm  int64
+
+	//the latest configuration included in the snapshot and the index of the config entry it comes from,
+	//NewServers is only set when that entry is a joint configuration, Learners and TargetServers while
+	//learners are catching up
+	Servers       string
+	NewServers    string
+	Learners      string
+	TargetServers string
+	ConfigIndex   int64
+	//the addresses of the servers
+	Members []*pb.Member
+}
+
+// on-disk form of a snapshot
+type snapshotFile struct {
+	Meta SnapshotMeta
+	Data []byte
+}
+
 type Persister struct {
-	mu sync.Mutex
+	mu  sync.Mutex
+	dir string
+
+	wal     *os.File
+	walSize int64
+	//the size of the wal when it was last rewritten, i.e. of the entries kept before the snapshot
+	walResetSize int64
+
+	//the latest snapshot is also cached in memory since leader sends it out to lagging peers
+	snapshot         []byte
+	snapshotMeta     SnapshotMeta
+	snapshotChecksum uint32
+	hasSnapshot      bool
+	//a snapshot in the format written before its metadata was, the kv-store alone, see ReadRaftState
+	legacySnapshot []byte
+}
+
+// Writes a snapshot received in chunks to a temporary file under the data directory.
+type SnapshotReceiver struct {
+	file   *os.File
+	offset int64
+	crc    uint32
+}
+
+// Returns the id of the server the data directory belongs to. On the first start the given id, or defaultID
+// if empty, is saved in the directory; later starts fail if the given id is another one.
+func LoadNodeID(dir string, id string, defaultID string) (string, error) {
+	return loadID(dir, nodeIDFileName, "server", id, func() (string, error) {
+		return defaultID, nil
+	})
+}
+
+// Returns the id of the cluster the data directory belongs to, like LoadNodeID. When it isn't known yet and no id
+// is given, a new one is generated if generate is set, otherwise it is empty until SaveClusterID.
+func LoadClusterID(dir string, id string, generate bool) (string, error) {
+	if !generate {
+		return loadID(dir, clusterIDFileName, "cluster", id, nil)
+	}
+	return loadID(dir, clusterIDFileName, "cluster", id, newClusterID)
+}
 
-	//the persistent fields as stated in the paper:
-	//currentTerm, votedFor, log[]
-	raftState []byte
-	snapshot  []byte
+//read the id saved in the named file of the data directory, or save the given or a generated one there
+func loadID(dir string, name string, kind string, id string, generate func() (string, error)) (string, error) {
+	path := filepath.Join(dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		stored := strings.TrimSpace(string(data))
+		if id != "" && id != stored {
+			return "", fmt.Errorf("the data directory %s belongs to %s %s, not %s", dir, kind, stored, id)
+		}
+		return stored, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if id == "" {
+		if generate == nil {
+			return "", nil
+		}
+		if id, err = generate(); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return id, writeFileAtomic(path, []byte(id+"\n"))
+}
+
+func MakePersister(dir string) *Persister {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Could not create data directory %s: %v", dir, err)
+	}
+
+	p := &Persister{dir: dir}
+
+	//snapshots whose writing was interrupted by a crash
+	tmps, _ := filepath.Glob(p.path(snapshotFileName + ".*.tmp"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	wal, err := os.OpenFile(p.path(walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("Could not open write-ahead log: %v", err)
+	}
+	p.wal = wal
+
+	data, err := ioutil.ReadFile(p.path(snapshotFileName))
+	if err == nil {
+		var snapshot snapshotFile
+		if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&snapshot); err != nil {
+			log.Printf("Snapshot without metadata, reading it in the old format: %v", err)
+			p.legacySnapshot = data
+		} else {
+			p.snapshot = snapshot.Data
+			p.snapshotMeta = snapshot.Meta
+			p.snapshotChecksum = crc32.ChecksumIEEE(snapshot.Data)
+			p.hasSnapshot = true
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Could not read snapshot: %v", err)
+	}
+
+	return p
 }
 
-func MakePersister() *Persister {
-	return &Persister{}
+func (p *Persister) path(name string) string {
+	return filepath.Join(p.dir, name)
 }
 
-func (p *Persister) SaveRaftState(data []byte) {
+// ReadRaftState replays the persisted states, ok is false if nothing was ever persisted.
+// A torn record at the tail of the wal (crash in the middle of an append) is discarded.
+func (p *Persister) ReadRaftState() (meta RaftMeta, entries []*pb.Entry, ok bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.raftState = data
+
+	data, err := ioutil.ReadFile(p.path(metaFileName))
+	if err == nil {
+		if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&meta); err != nil {
+			log.Fatalf("Could not decode raft meta: %v", err)
+		}
+		ok = true
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Could not read raft meta: %v", err)
+	}
+
+	if _, err := p.wal.Seek(0, io.SeekStart); err != nil {
+		log.Fatalf("Could not seek write-ahead log: %v", err)
+	}
+	info, err := p.wal.Stat()
+	if err != nil {
+		log.Fatalf("Could not stat write-ahead log: %v", err)
+	}
+	reader := bufio.NewReader(p.wal)
+	var offset int64
+	for {
+		record, n, err := readWalRecord(reader, info.Size()-offset)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Discarding the tail of write-ahead log from offset %d: %v", offset, err)
+			break
+		}
+		offset += n
+		//ResetLog writes the whole log as a single record
+		if p.walResetSize == 0 {
+			p.walResetSize = n
+		}
+
+		entries = applyWalRecord(entries, record)
+		ok = true
+	}
+
+	//drop whatever is beyond the last good record and continue appending from there
+	if err := p.wal.Truncate(offset); err != nil {
+		log.Fatalf("Could not truncate write-ahead log: %v", err)
+	}
+	if _, err := p.wal.Seek(offset, io.SeekStart); err != nil {
+		log.Fatalf("Could not seek write-ahead log: %v", err)
+	}
+	p.walSize = offset
+
+	//the log of the old format starts at the last entry included in its snapshot,
+	//which becomes the metadata of the snapshot saved in the current format
+	if p.legacySnapshot != nil {
+		if len(entries) > 0 && entries[0].Index > 0 {
+			log.Printf("Upgrading the snapshot up to index %d to the current format.", entries[0].Index)
+			snapshotMeta := SnapshotMeta{LastIncludedIndex: entries[0].Index, LastIncludedTerm: entries[0].Term}
+			p.installSnapshotFile(p.writeSnapshotFile(snapshotMeta, p.legacySnapshot), snapshotMeta, p.legacySnapshot)
+		}
+		p.legacySnapshot = nil
+	}
+
+	return meta, entries, ok
 }
 
-func (p *Persister) ReadRaftState() []byte {
+// SaveClusterID saves the id of the cluster adopted from its leader.
+func (p *Persister) SaveClusterID(id string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.raftState
+	if err := writeFileAtomic(p.path(clusterIDFileName), []byte(id+"\n")); err != nil {
+		log.Fatalf("Could not save cluster id: %v", err)
+	}
+}
+
+// SaveMeta atomically replaces the persisted term and vote.
+func (p *Persister) SaveMeta(meta RaftMeta) {
+	write := new(bytes.Buffer)
+	encoder := gob.NewEncoder(write)
+	if err := encoder.Encode(meta); err != nil {
+		log.Fatalf("Could not encode raft meta: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := writeFileAtomic(p.path(metaFileName), write.Bytes()); err != nil {
+		log.Fatalf("Could not save raft meta: %v", err)
+	}
+}
+
+// AppendLog appends a record to the wal and fsyncs it before returning.
+func (p *Persister) AppendLog(truncateFrom int64, entries []*pb.Entry) {
+	data := encodeWalRecord(walRecord{TruncateFrom: truncateFrom, Entries: entries})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.wal.Write(data); err != nil {
+		log.Fatalf("Could not append to write-ahead log: %v", err)
+	}
+	if err := p.wal.Sync(); err != nil {
+		log.Fatalf("Could not sync write-ahead log: %v", err)
+	}
+	p.walSize += int64(len(data))
+}
+
+// ResetLog atomically replaces the whole wal with the given entries,
+// used when the head of the log is discarded (compaction / install snapshot).
+func (p *Persister) ResetLog(entries []*pb.Entry) {
+	data := encodeWalRecord(walRecord{Entries: entries})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := writeFileAtomic(p.path(walFileName), data); err != nil {
+		log.Fatalf("Could not rewrite write-ahead log: %v", err)
+	}
+
+	wal, err := os.OpenFile(p.path(walFileName), os.O_RDWR, 0644)
+	if err != nil {
+		log.Fatalf("Could not open write-ahead log: %v", err)
+	}
+	if _, err := wal.Seek(0, io.SeekEnd); err != nil {
+		log.Fatalf("Could not seek write-ahead log: %v", err)
+	}
+	p.wal.Close()
+	p.wal = wal
+	p.walSize = int64(len(data))
+	p.walResetSize = p.walSize
 }
 
 func (p *Persister) RaftStateSize() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return len(p.raftState)
+	return int(p.walSize)
+}
+
+// LogSizeSinceReset is the size of the wal records appended since it was last rewritten by ResetLog,
+// the trailing entries kept after a compaction don't count.
+func (p *Persister) LogSizeSinceReset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int(p.walSize - p.walResetSize)
 }
 
-func (p *Persister) SaveSnapshot(snapshot []byte) {
+// SaveSnapshot atomically replaces the persisted snapshot together with its metadata.
+func (p *Persister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) {
+	tmp := p.writeSnapshotFile(meta, snapshot)
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.installSnapshotFile(tmp, meta, snapshot)
+}
+
+//encode the snapshot with its metadata into a new temporary file of the data directory, synced to disk.
+//it doesn't need p.mu, each call has its own file
+func (p *Persister) writeSnapshotFile(meta SnapshotMeta, snapshot []byte) string {
+	write := new(bytes.Buffer)
+	encoder := gob.NewEncoder(write)
+	if err := encoder.Encode(snapshotFile{Meta: meta, Data: snapshot}); err != nil {
+		log.Fatalf("Could not encode snapshot: %v", err)
+	}
+
+	f, err := ioutil.TempFile(p.dir, snapshotFileName+".*.tmp")
+	if err != nil {
+		log.Fatalf("Could not create snapshot file: %v", err)
+	}
+	if err := writeFileSynced(f, write.Bytes()); err != nil {
+		log.Fatalf("Could not write snapshot: %v", err)
+	}
+	return f.Name()
+}
+
+//replace the persisted snapshot by the file written by writeSnapshotFile, the caller holds p.mu
+func (p *Persister) installSnapshotFile(tmp string, meta SnapshotMeta, snapshot []byte) {
+	if err := renameSynced(tmp, p.path(snapshotFileName)); err != nil {
+		log.Fatalf("Could not save snapshot: %v", err)
+	}
 	p.snapshot = snapshot
+	p.snapshotMeta = meta
+	p.snapshotChecksum = crc32.ChecksumIEEE(snapshot)
+	p.hasSnapshot = true
+}
+
+// ReadSnapshotWithMeta returns the latest snapshot together with its metadata and crc32.
+// Unlike separate calls, they are sure to come from the same snapshot when one is saved in the background.
+func (p *Persister) ReadSnapshotWithMeta() (SnapshotMeta, []byte, uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.snapshotMeta, p.snapshot, p.snapshotChecksum
+}
+
+// NewSnapshotReceiver starts receiving a snapshot, replacing any partially received one.
+func (p *Persister) NewSnapshotReceiver() *SnapshotReceiver {
+	file, err := os.OpenFile(p.path(incomingSnapshotFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("Could not create incoming snapshot file: %v", err)
+	}
+	return &SnapshotReceiver{file: file}
+}
+
+// Offset is the number of bytes received so far.
+func (sr *SnapshotReceiver) Offset() int64 {
+	return sr.offset
+}
+
+// Write appends the next chunk of the snapshot.
+func (sr *SnapshotReceiver) Write(chunk []byte) {
+	if _, err := sr.file.Write(chunk); err != nil {
+		log.Fatalf("Could not write incoming snapshot: %v", err)
+	}
+	sr.offset += int64(len(chunk))
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, chunk)
+}
+
+// Finish returns the whole snapshot once all chunks are received, ok is false if it doesn't match the checksum.
+// The receiver can't be used afterwards.
+func (sr *SnapshotReceiver) Finish(checksum uint32) (data []byte, ok bool) {
+	defer sr.Abort()
+	if sr.crc != checksum {
+		return nil, false
+	}
+
+	data = make([]byte, sr.offset)
+	if _, err := sr.file.ReadAt(data, 0); err != nil {
+		log.Fatalf("Could not read incoming snapshot: %v", err)
+	}
+	return data, true
+}
+
+// Abort discards the partially received snapshot.
+func (sr *SnapshotReceiver) Abort() {
+	sr.file.Close()
+	os.Remove(sr.file.Name())
+}
+
+// SaveSnapshotIfNewer saves the snapshot unless the persisted one already covers more of the log,
+// e.g. the leader installed a newer one while this one was being taken. It returns whether it was saved.
+func (p *Persister) SaveSnapshotIfNewer(meta SnapshotMeta, snapshot []byte) bool {
+	//the snapshot is written without the lock so the main loop keeps persisting in the meantime,
+	//it is checked and renamed under the same lock so an installed snapshot saved in between isn't overwritten
+	tmp := p.writeSnapshotFile(meta, snapshot)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	newer := !p.hasSnapshot || meta.LastIncludedIndex > p.snapshotMeta.LastIncludedIndex
+	if newer {
+		p.installSnapshotFile(tmp, meta, snapshot)
+	} else {
+		os.Remove(tmp)
+	}
+	return newer
+}
+
+// ReadSnapshotMeta returns the metadata of the latest snapshot, ok is false if none was taken.
+func (p *Persister) ReadSnapshotMeta() (meta SnapshotMeta, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.snapshotMeta, p.hasSnapshot
 }
 
 func (p *Persister) ReadSnapshot() []byte {
@@ -57,3 +473,119 @@ func (p *Persister) SnapshotSize() int {
 	defer p.mu.Unlock()
 	return len(p.snapshot)
 }
+
+func applyWalRecord(entries []*pb.Entry, record walRecord) []*pb.Entry {
+	if record.TruncateFrom > 0 {
+		for i, entry := range entries {
+			if entry.Index >= record.TruncateFrom {
+				entries = entries[:i]
+				break
+			}
+		}
+	}
+	return append(entries, record.Entries...)
+}
+
+func encodeWalRecord(record walRecord) []byte {
+	recordData := walRecordData{TruncateFrom: record.TruncateFrom}
+	for _, entry := range record.Entries {
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			log.Fatalf("Could not encode log entry %d: %v", entry.Index, err)
+		}
+		recordData.Entries = append(recordData.Entries, data)
+	}
+
+	payload := new(bytes.Buffer)
+	encoder := gob.NewEncoder(payload)
+	if err := encoder.Encode(recordData); err != nil {
+		log.Fatalf("Could not encode wal record: %v", err)
+	}
+
+	data := make([]byte, walHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(data[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(data[walHeaderSize:], payload.Bytes())
+	return data
+}
+
+// returns the decoded record and the number of bytes it occupies in the wal,
+// remaining is the number of bytes left in the wal from the start of the record
+func readWalRecord(reader io.Reader, remaining int64) (walRecord, int64, error) {
+	var record walRecord
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err == io.EOF {
+		return record, 0, io.EOF
+	} else if err != nil {
+		return record, 0, errCorruptRecord
+	}
+
+	//a corrupt header may claim more than the wal holds, don't allocate it
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > remaining-walHeaderSize {
+		return record, 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return record, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return record, 0, errCorruptRecord
+	}
+
+	var recordData walRecordData
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(&recordData); err != nil {
+		return record, 0, errCorruptRecord
+	}
+	record.TruncateFrom = recordData.TruncateFrom
+	for _, data := range recordData.Entries {
+		entry := &pb.Entry{}
+		if err := proto.Unmarshal(data, entry); err != nil {
+			return record, 0, errCorruptRecord
+		}
+		record.Entries = append(record.Entries, entry)
+	}
+	return record, int64(walHeaderSize + len(payload)), nil
+}
+
+// write to a temp file, fsync it and rename it over the target,
+// so a crash leaves either the old or the new content but never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSynced(f, data); err != nil {
+		return err
+	}
+	return renameSynced(tmp, path)
+}
+
+// write the data to the file, fsync and close it
+func writeFileSynced(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rename the file over the target and fsync the directory so the rename itself is durable
+func renameSynced(tmp string, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
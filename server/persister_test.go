@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/raft/pb"
+)
+
+func walEntries(first int64, last int64, term int64) []*pb.Entry {
+	var entries []*pb.Entry
+	for i := first; i <= last; i++ {
+		entries = append(entries, &pb.Entry{Index: i, Term: term})
+	}
+	return entries
+}
+
+func entryIndexes(entries []*pb.Entry) []int64 {
+	indexes := []int64{}
+	for _, entry := range entries {
+		indexes = append(indexes, entry.Index)
+	}
+	return indexes
+}
+
+//replay the wal the way ReadRaftState does, returns the replayed entries and the offset of the last good record
+func replayWal(wal []byte) ([]*pb.Entry, int64) {
+	reader := bytes.NewReader(wal)
+	var entries []*pb.Entry
+	var offset int64
+	for {
+		record, n, err := readWalRecord(reader, int64(len(wal))-offset)
+		if err != nil {
+			return entries, offset
+		}
+		offset += n
+		entries = applyWalRecord(entries, record)
+	}
+}
+
+func TestReadWalRecord(t *testing.T) {
+	first := encodeWalRecord(walRecord{Entries: walEntries(1, 3, 1)})
+	second := encodeWalRecord(walRecord{TruncateFrom: 3, Entries: walEntries(3, 4, 2)})
+	wal := append(append([]byte{}, first...), second...)
+
+	hugeLength := append([]byte{}, second...)
+	binary.BigEndian.PutUint32(hugeLength[0:4], 0xffffffff)
+	badCrc := append([]byte{}, second...)
+	badCrc[4] ^= 0xff
+	badPayload := append([]byte{}, second...)
+	badPayload[len(badPayload)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		wal     []byte
+		indexes []int64
+		offset  int64
+	}{
+		{"empty", nil, []int64{}, 0},
+		{"complete", wal, []int64{1, 2, 3, 4}, int64(len(wal))},
+		{"torn header", wal[:len(first)+walHeaderSize/2], []int64{1, 2, 3}, int64(len(first))},
+		{"torn payload", wal[:len(wal)-1], []int64{1, 2, 3}, int64(len(first))},
+		{"huge length", append(append([]byte{}, first...), hugeLength...), []int64{1, 2, 3}, int64(len(first))},
+		{"bad crc", append(append([]byte{}, first...), badCrc...), []int64{1, 2, 3}, int64(len(first))},
+		{"bad payload", append(append([]byte{}, first...), badPayload...), []int64{1, 2, 3}, int64(len(first))},
+		{"corrupt first record", badCrc, []int64{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, offset := replayWal(tt.wal)
+			if indexes := entryIndexes(entries); !reflect.DeepEqual(indexes, tt.indexes) {
+				t.Fatalf("Replayed entries %v, want %v", indexes, tt.indexes)
+			}
+			if offset != tt.offset {
+				t.Fatalf("Last good record ends at %d, want %d", offset, tt.offset)
+			}
+		})
+	}
+}
+
+func TestReadWalRecordErrors(t *testing.T) {
+	record := encodeWalRecord(walRecord{Entries: walEntries(1, 1, 1)})
+
+	if _, _, err := readWalRecord(bytes.NewReader(nil), 0); err != io.EOF {
+		t.Fatalf("Empty wal should return io.EOF, got %v", err)
+	}
+	if _, _, err := readWalRecord(bytes.NewReader(record[:3]), 3); err != errCorruptRecord {
+		t.Fatalf("Torn header should return errCorruptRecord, got %v", err)
+	}
+	//the length is checked against what is left in the wal before reading the payload
+	if _, _, err := readWalRecord(bytes.NewReader(record), int64(len(record)-1)); err != errCorruptRecord {
+		t.Fatalf("Length beyond the wal should return errCorruptRecord, got %v", err)
+	}
+	if _, n, err := readWalRecord(bytes.NewReader(record), int64(len(record))); err != nil || n != int64(len(record)) {
+		t.Fatalf("Read %d bytes, %v, want %d bytes", n, err, len(record))
+	}
+}
+
+func TestApplyWalRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*pb.Entry
+		record  walRecord
+		indexes []int64
+	}{
+		{"append to empty", nil, walRecord{Entries: walEntries(1, 2, 1)}, []int64{1, 2}},
+		{"append", walEntries(1, 2, 1), walRecord{Entries: walEntries(3, 3, 1)}, []int64{1, 2, 3}},
+		{"truncate the tail", walEntries(1, 5, 1), walRecord{TruncateFrom: 3, Entries: walEntries(3, 4, 2)}, []int64{1, 2, 3, 4}},
+		{"truncate everything", walEntries(1, 3, 1), walRecord{TruncateFrom: 1}, []int64{}},
+		{"truncate beyond the log", walEntries(1, 3, 1), walRecord{TruncateFrom: 10, Entries: walEntries(4, 4, 1)}, []int64{1, 2, 3, 4}},
+		//a log starting after a snapshot
+		{"truncate before the first entry", walEntries(5, 7, 1), walRecord{TruncateFrom: 2, Entries: walEntries(8, 8, 2)}, []int64{8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := applyWalRecord(tt.entries, tt.record)
+			if indexes := entryIndexes(entries); !reflect.DeepEqual(indexes, tt.indexes) {
+				t.Fatalf("Got entries %v, want %v", indexes, tt.indexes)
+			}
+		})
+	}
+
+	//the entries after the truncation are the ones of the record
+	entries := applyWalRecord(walEntries(1, 3, 1), walRecord{TruncateFrom: 2, Entries: walEntries(2, 2, 5)})
+	if entries[1].Term != 5 {
+		t.Fatalf("Entry 2 has term %d after truncation, want 5", entries[1].Term)
+	}
+}
+
+func TestReadRaftStateDiscardsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	p := MakePersister(dir)
+	p.AppendLog(0, walEntries(0, 2, 1))
+	p.AppendLog(2, walEntries(2, 3, 2))
+	size := p.walSize
+
+	//a crash in the middle of the next append
+	torn := encodeWalRecord(walRecord{Entries: walEntries(4, 4, 2)})
+	if _, err := p.wal.Write(torn[:len(torn)-2]); err != nil {
+		t.Fatalf("Could not write the torn record %v", err)
+	}
+	p.wal.Close()
+
+	p = MakePersister(dir)
+	defer p.wal.Close()
+	_, entries, ok := p.ReadRaftState()
+	if !ok {
+		t.Fatalf("The raft state should be found")
+	}
+	if indexes := entryIndexes(entries); !reflect.DeepEqual(indexes, []int64{0, 1, 2, 3}) {
+		t.Fatalf("Recovered entries %v, want [0 1 2 3]", indexes)
+	}
+	if p.walSize != size {
+		t.Fatalf("The wal should be truncated to %d, got %d", size, p.walSize)
+	}
+}
+
+func TestLoadNodeID(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   string
+		then    string
+		id      string
+		invalid bool
+	}{
+		{"default to the raft address", "", "", "host:3001", false},
+		{"given id", "s1", "", "s1", false},
+		{"same id given again", "s1", "s1", "s1", false},
+		{"other id given", "s1", "s2", "", true},
+		{"id given after the default", "", "s1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, err := LoadNodeID(dir, tt.first, "host:3001"); err != nil {
+				t.Fatalf("First start failed %v", err)
+			}
+			//the raft address may change, the saved id stays
+			id, err := LoadNodeID(dir, tt.then, "other:3001")
+			if (err != nil) != tt.invalid {
+				t.Fatalf("Restart returned %v, want an error: %v", err, tt.invalid)
+			}
+			if !tt.invalid && id != tt.id {
+				t.Fatalf("Got id %q, want %q", id, tt.id)
+			}
+		})
+	}
+}
+
+func TestSaveSnapshotIfNewer(t *testing.T) {
+	dir := t.TempDir()
+	p := MakePersister(dir)
+
+	if !p.SaveSnapshotIfNewer(SnapshotMeta{LastIncludedIndex: 5, LastIncludedTerm: 1}, []byte("five")) {
+		t.Fatalf("The first snapshot should be saved")
+	}
+	//e.g. a snapshot installed from the leader while ours was being written
+	p.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 10, LastIncludedTerm: 2}, []byte("ten"))
+	if p.SaveSnapshotIfNewer(SnapshotMeta{LastIncludedIndex: 8, LastIncludedTerm: 2}, []byte("eight")) {
+		t.Fatalf("An older snapshot should not be saved")
+	}
+	if !p.SaveSnapshotIfNewer(SnapshotMeta{LastIncludedIndex: 12, LastIncludedTerm: 2}, []byte("twelve")) {
+		t.Fatalf("A newer snapshot should be saved")
+	}
+	p.wal.Close()
+
+	if tmps, _ := filepath.Glob(filepath.Join(dir, snapshotFileName+".*.tmp")); len(tmps) != 0 {
+		t.Fatalf("Temporary snapshot files left %v", tmps)
+	}
+	p = MakePersister(dir)
+	defer p.wal.Close()
+	meta, data, _ := p.ReadSnapshotWithMeta()
+	if meta.LastIncludedIndex != 12 || string(data) != "twelve" {
+		t.Fatalf("Read snapshot %q up to %d, want %q up to 12", data, meta.LastIncludedIndex, "twelve")
+	}
+}
+
+func TestLogSizeSinceReset(t *testing.T) {
+	dir := t.TempDir()
+	p := MakePersister(dir)
+	p.AppendLog(0, walEntries(0, 10, 1))
+	if size := p.LogSizeSinceReset(); size != p.RaftStateSize() {
+		t.Fatalf("Size since reset %d, want the whole wal %d before any reset", size, p.RaftStateSize())
+	}
+
+	//the entries kept after a compaction don't count
+	p.ResetLog(walEntries(5, 10, 1))
+	if size := p.LogSizeSinceReset(); size != 0 {
+		t.Fatalf("Size since reset %d right after the reset, want 0", size)
+	}
+	record := encodeWalRecord(walRecord{Entries: walEntries(11, 12, 1)})
+	p.AppendLog(0, walEntries(11, 12, 1))
+	if size := p.LogSizeSinceReset(); size != len(record) {
+		t.Fatalf("Size since reset %d, want %d", size, len(record))
+	}
+	p.wal.Close()
+
+	//a restart counts from the record written by the reset
+	p = MakePersister(dir)
+	defer p.wal.Close()
+	p.ReadRaftState()
+	if size := p.LogSizeSinceReset(); size != len(record) {
+		t.Fatalf("Size since reset %d after a restart, want %d", size, len(record))
+	}
+}
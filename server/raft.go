@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"log"
 	rand "math/rand"
 	"strings"
@@ -20,15 +18,67 @@ const (
 	candidate = 2
 	leader    = 3
 	// for cluster membership change
-	//shutdown  = 4
+	removed = 4 //removed from the configuration, the server no longer takes part in the cluster
 
 	//different timeout in ms
 	ELECTION_TIMEOUT_LOWER_BOUND = 1000
 	ELECTION_TIMEOUT_UPPER_BOUND = 4000
 	HEARTBEAT_TIMEOUT            = 500
-	LOG_COMPACTION_LIMIT         = 300 //-1 means no log compaction
+	CLOCK_DRIFT_BOUND            = 200 //default bound of clock drift between servers for leader lease
+
+	//default limits of log replication, entries / bytes per append entries and append entries in flight per peer
+	MAX_APPEND_ENTRIES = 64
+	MAX_APPEND_BYTES   = 1 << 20
+	MAX_INFLIGHT       = 4
+
+	//default limits of a batch of client requests appended to the log together
+	MAX_BATCH      = 64
+	MAX_BATCH_WAIT = 0 //in ms, 0 means no waiting for more requests
+
+	//default compaction policy, a snapshot is taken once any threshold is reached, 0 disables a threshold
+	SNAPSHOT_ENTRIES  = 300      //entries applied since the last snapshot
+	SNAPSHOT_BYTES    = 64 << 20 //size of the wal appended since the last snapshot
+	SNAPSHOT_INTERVAL = 0        //in seconds since the last snapshot
+	SNAPSHOT_TRAILING = 100      //entries kept in the log before the snapshot for lagging followers
+
+	//default number of entries a learner may lag behind the leader's last log index to be promoted
+	LEARNER_CATCH_UP = 100
 )
 
+// Tunable options of a Raft server, given through the command line flags
+type Options struct {
+	dataDir    string
+	readMode   int
+	clockDrift time.Duration
+
+	maxAppendEntries int
+	maxAppendBytes   int
+	maxInflight      int
+
+	maxBatch     int
+	maxBatchWait time.Duration
+
+	snapshotEntries  int64
+	snapshotBytes    int
+	snapshotInterval time.Duration
+	snapshotTrailing int64
+
+	learnerCatchUp int64
+
+	//the addresses this server is reached at, and the raft addresses of the -peer servers by id
+	raftAddress   string
+	clientAddress string
+	peerAddresses map[string]string
+
+	//the id of the cluster, empty if it is adopted from the first leader we hear from on -join
+	clusterID string
+
+	//how to start with an empty data directory: form a new cluster with the -peer servers,
+	//or ask the servers at the given client endpoints to be added
+	bootstrap bool
+	join      []string
+}
+
 type voteInfo struct {
 	mu         sync.Mutex
 	voteRecord map[string]bool
@@ -36,11 +86,14 @@ type voteInfo struct {
 }
 
 type AppendResponse struct {
-	ret         *pb.AppendEntriesRet
-	err         error
-	peer        string
-	matchIndex  int64
-	requestTerm int64
+	ret          *pb.AppendEntriesRet
+	err          error
+	peer         string
+	prevLogIndex int64
+	matchIndex   int64
+	requestTerm  int64
+	round        int64
+	sentAt       time.Time
 }
 
 type VoteResponse struct {
@@ -55,6 +108,10 @@ type InstallSnapshotResponse struct {
 	err         error
 	peer        string
 	requestTerm int64
+	//the chunk that was sent
+	lastIncludedIndex int64
+	offset            int64
+	length            int64
 }
 
 // Messages that can be passed from the Raft RPC server to the main loop for AppendEntries
@@ -69,6 +126,19 @@ type VoteInput struct {
 	response chan pb.RequestVoteRet
 }
 
+// Messages that can be passed from the Raft RPC server to the main loop for ReadIndex
+type ReadIndexInput struct {
+	arg      *pb.ReadIndexArgs
+	response chan pb.ReadIndexRet
+}
+
+// The leader's reply to a ReadIndex request made by a follower on behalf of a client read
+type ReadIndexResponse struct {
+	ret *pb.ReadIndexRet
+	err error
+	op  InputChannelType
+}
+
 // Messages that can be passed from the Raft RPC server to the main loop for InstallSnapshot
 type InstallSnapshotInput struct {
 	arg      *pb.InstallSnapshotArgs
@@ -79,6 +149,9 @@ type InstallSnapshotInput struct {
 type Raft struct {
 	AppendChan          chan AppendEntriesInput
 	VoteChan            chan VoteInput
+	PreVoteChan         chan VoteInput
+	ReadIndexChan       chan ReadIndexInput
+	TimeoutNowChan      chan TimeoutNowInput
 	InstallSnapshotChan chan InstallSnapshotInput
 
 	//lock to protect shared access to this raft server state
@@ -88,6 +161,13 @@ type Raft struct {
 	me        string
 	leader    string
 	persister *Persister // Object to hold the raft persisted states
+	opts      Options
+
+	//the id of our cluster, the RPC handlers check it outside of the main loop so it has its own lock
+	clusterMu sync.Mutex
+	clusterID string
+	//set while we wait to be added by -join without a cluster id, the first leader's id is adopted
+	adoptClusterIDOnJoin bool
 
 	state      int64
 	quorumSize int64
@@ -98,6 +178,13 @@ type Raft struct {
 	lastVoteTerm int64
 	log          []*pb.Entry
 
+	//how far the log is durable in the write-ahead log
+	//and the lowest index deleted from the log since the last persist (0 if none)
+	persistedLogIndex int64
+	logTruncatedFrom  int64
+	//the term and vote as last written, the meta file is only rewritten when they change
+	persistedMeta RaftMeta
+
 	//this raft server volatile states
 	commitIndex int64
 	lastApplied int64
@@ -107,12 +194,39 @@ type Raft struct {
 	matchIndex map[string]int64
 	//map of logIndex -> client response ch
 	clientsResponse map[int64]chan pb.Result
+	//the last time each peer replied to us in our term, for check quorum
+	lastContact map[string]time.Time
 
 	//timer & ticker for election timeout and heartbeat
 	electionTimer  *time.Timer
 	heartBeatTimer *time.Timer
 	randSeed       *rand.Rand
 
+	//reads waiting for leadership confirmation / state machine to catch up (ReadIndex),
+	//the current heartbeat round and the latest one each peer has acknowledged in our term
+	pendingReads   []*readRequest
+	heartbeatRound int64
+	peerAckRound   map[string]int64
+	//the send time of the latest request each peer has acknowledged in our term, for leader lease
+	peerAckTime map[string]time.Time
+	//pipelined replication state of each peer
+	streams map[string]*replicationStream
+
+	//leadership transfer in progress, aborted when the timer fires
+	transfer      *leadershipTransfer
+	transferTimer *time.Timer
+
+	//snapshot being received from the leader in chunks, nil if none
+	incomingSnapshot *incomingSnapshot
+	//snapshot being written in the background, the log is compacted once it is durable
+	snapshotting     bool
+	lastSnapshotTime time.Time
+	SnapshotDoneChan chan SnapshotDone
+
+	//pre-vote round in progress (before becoming candidate), and the last time we heard from a valid leader
+	preVoting         bool
+	lastLeaderContact time.Time
+
 	//peers
 	peers *arrayPeers
 
@@ -122,7 +236,9 @@ type Raft struct {
 	//for membership/configurations changes
 	configurations Configurations
 	peerClients    map[string]pb.RaftClient
-	killServer     chan int64
+	//servers removed by the latest config entry, told about it once the entry is committed
+	departing  map[string]pb.RaftClient
+	killServer chan int64
 }
 
 //to get the server list from the current active configuration
@@ -138,21 +254,69 @@ func (r *Raft) isEqualToCurrentServerList(list string) bool {
 }
 
 func (r *Raft) updateConfiguration() {
-	var currServers arrayPeers
-
-	entry, ok := r.getLogEntry(r.configurations.lastConfigLogIndex)
+	servers, ok := r.configEntryAt(r.configurations.lastConfigLogIndex)
 	if !ok {
 		log.Fatalf("Something wrong with updating configurations, config log entry not found")
 	}
+	r.configurations.config = configurationOf(servers)
+}
 
-	currServers.SetArray(strings.Split(entry.Cmd.GetServers().CurrList, ","))
-	if entry.Cmd.GetServers().GetNewList() != "" {
+//the servers of a config entry, the current list merged with the new one in a joint configuration
+func configurationOf(servers *pb.Servers) Configuration {
+	var currServers arrayPeers
+	if servers.GetCurrList() != "" { //empty in the initial config entry of a server joining a cluster
+		currServers.SetArray(strings.Split(servers.CurrList, ","))
+	}
+	if servers.GetNewList() != "" {
 		var newServers arrayPeers
-		newServers.SetArray(strings.Split(entry.Cmd.GetServers().NewList, ","))
+		newServers.SetArray(strings.Split(servers.NewList, ","))
 		currServers = *currServers.Merge(&newServers)
 	}
 
-	r.configurations.config = Configuration{servers: &currServers}
+	var learners arrayPeers
+	if servers.GetLearners() != "" {
+		for _, learner := range strings.Split(servers.Learners, ",") {
+			if !currServers.Contains(learner) {
+				learners.Set(learner)
+			}
+		}
+	}
+	return Configuration{servers: &currServers, learners: &learners}
+}
+
+//whether no membership change is in progress in the config entry, neither a joint configuration nor learners
+//catching up
+func isStableConfig(servers *pb.Servers) bool {
+	return servers.GetNewList() == "" && servers.GetLearners() == ""
+}
+
+//the config entry at the given index, from the log or from the snapshot metadata if it has been compacted
+func (r *Raft) configEntryAt(index int64) (*pb.Servers, bool) {
+	if entry, ok := r.getLogEntry(index); ok && entry.Cmd != nil && entry.Cmd.Operation == pb.Op_CONFIG_CHG {
+		return entry.Cmd.GetServers(), true
+	}
+	if meta, ok := r.persister.ReadSnapshotMeta(); ok && meta.ConfigIndex == index && meta.Servers != "" {
+		return meta.config(), true
+	}
+	return nil, false
+}
+
+//the latest config entry up to the given index and its index, i.e. the configuration a snapshot up to it includes
+func (r *Raft) configAsOf(index int64) (*pb.Servers, int64) {
+	for i := min(index, r.getLastLogIndex()); i >= r.getFirstLogIndex(); i-- {
+		entry, _ := r.getLogEntry(i)
+		if entry.Cmd != nil && entry.Cmd.Operation == pb.Op_CONFIG_CHG {
+			return entry.Cmd.GetServers(), entry.Index
+		}
+	}
+	meta, _ := r.persister.ReadSnapshotMeta()
+	return meta.config(), meta.ConfigIndex
+}
+
+//the configuration recorded in the snapshot metadata, as a config entry
+func (m SnapshotMeta) config() *pb.Servers {
+	return &pb.Servers{CurrList: m.Servers, NewList: m.NewServers, Learners: m.Learners, TargetList: m.TargetServers,
+		Members: m.Members}
 }
 
 //to check given sever is our peer given the current configuration
@@ -160,19 +324,190 @@ func (r *Raft) isPeer(server string) bool {
 	return r.getServerList().Contains(server)
 }
 
+//the servers the log is replicated to, the voting ones and the learners
+func (r *Raft) getMembers() *arrayPeers {
+	members := r.getServerList().Clone()
+	if learners := r.configurations.config.learners; learners != nil {
+		members.SetArray(*learners)
+	}
+	return members
+}
+
+//to check given server is a voting server or a learner given the current configuration
+func (r *Raft) isMember(server string) bool {
+	return r.isPeer(server) || r.configurations.config.learners != nil && r.configurations.config.learners.Contains(server)
+}
+
+//the result to send the client to the leader we know of,
+//an empty server tells the client the leader is not yet known
+func (r *Raft) redirectResult() pb.Result {
+	server := ""
+	if r.leader != "" && r.leader != r.me { //we just stepped down, the new leader is not yet known
+		member := r.memberAddresses(r.leader)
+		server = member.ClientAddress
+		if server == "" {
+			//only the host is known, the client uses the port of its own endpoints
+			server = strings.Split(member.RaftAddress, ":")[0]
+		}
+	}
+	return pb.Result{Result: &pb.Result_Redirect{Redirect: &pb.Redirect{Server: server}}}
+}
+
 func (r *Raft) Kill() {
 	r.killServer <- 1
 }
 
 //to save persistent raft states
+//term & vote are replaced as a whole, while only the log entries not yet durable are appended to the wal
 func (r *Raft) persist() {
-	write := new(bytes.Buffer)
-	encoder := gob.NewEncoder(write)
-	encoder.Encode(r.currentTerm)
-	encoder.Encode(r.votedFor)
-	encoder.Encode(r.log)
-	data := write.Bytes()
-	r.persister.SaveRaftState(data)
+	if meta := (RaftMeta{CurrentTerm: r.currentTerm, VotedFor: r.votedFor, LastVoteTerm: r.lastVoteTerm}); meta != r.persistedMeta {
+		r.persister.SaveMeta(meta)
+		r.persistedMeta = meta
+	}
+
+	//only the entries appended since the last persist are written, plus the truncation if any
+	if r.logTruncatedFrom > 0 || r.persistedLogIndex < r.getLastLogIndex() {
+		r.persister.AppendLog(r.logTruncatedFrom, r.getEntryFrom(r.persistedLogIndex+1))
+		r.persistedLogIndex = r.getLastLogIndex()
+		r.logTruncatedFrom = 0
+	}
+}
+
+//to rewrite the wal with the current log, after the head of the log is discarded
+func (r *Raft) persistCompactedLog() {
+	r.persister.ResetLog(r.log)
+	r.persistedLogIndex = r.getLastLogIndex()
+	r.logTruncatedFrom = 0
+}
+
+//to restore the raft states persisted before a restart, return false if there is none
+//the state machine is loaded from the latest snapshot, and only the log suffix after it (plus the trailing entries) is kept
+func (r *Raft) readPersist(s *KVStore) bool {
+	meta, entries, ok := r.persister.ReadRaftState()
+	if !ok || len(entries) == 0 {
+		return false
+	}
+
+	r.currentTerm = meta.CurrentTerm
+	r.votedFor = meta.VotedFor
+	r.lastVoteTerm = meta.LastVoteTerm
+	r.persistedMeta = meta
+	r.log = entries
+
+	if snapshotMeta, ok := r.persister.ReadSnapshotMeta(); ok {
+		log.Printf("Restoring from snapshot, lastIncludedIndex: %d, lastIncludedTerm: %d.",
+			snapshotMeta.LastIncludedIndex, snapshotMeta.LastIncludedTerm)
+		r.lastSnapshotLogEntry = &pb.Entry{Term: snapshotMeta.LastIncludedTerm, Index: snapshotMeta.LastIncludedIndex}
+
+		//the wal keeps the trailing entries before the snapshot, and possibly more if we crashed before it was
+		//rewritten; they match the snapshot as long as its last included entry does
+		entry, ok := r.getLogEntry(r.lastSnapshotLogEntry.Index)
+		if ok && entry.Term == r.lastSnapshotLogEntry.Term {
+			if trailingFrom := entry.Index - r.opts.snapshotTrailing; trailingFrom > r.getFirstLogIndex() {
+				r.log = r.getEntryFrom(trailingFrom)
+			}
+		} else {
+			r.deleteAllEntries()
+		}
+
+		s.ApplySnapshot(r.persister.ReadSnapshot())
+		r.commitIndex = r.lastSnapshotLogEntry.Index
+		r.lastApplied = r.lastSnapshotLogEntry.Index
+		r.restoreConfiguration(snapshotMeta)
+
+		r.persistCompactedLog()
+	} else {
+		r.persistedLogIndex = r.getLastLogIndex()
+		r.restoreConfiguration(SnapshotMeta{})
+	}
+
+	log.Printf("Restored persisted states, currentTerm: %d, votedFor: %s, firstLogIndex: %d, lastLogIndex: %d.",
+		r.currentTerm, r.votedFor, r.getFirstLogIndex(), r.getLastLogIndex())
+	return true
+}
+
+//to rebuild the configurations after a restart or an installed snapshot, the latest config entry in the log
+//suffix wins, otherwise it is the one recorded in the snapshot metadata
+func (r *Raft) restoreConfiguration(snapshotMeta SnapshotMeta) {
+	if entry, ok := r.findLastConfigEntry(); ok && entry.Index >= snapshotMeta.ConfigIndex {
+		r.configurations.lastConfigLogIndex = entry.Index
+		r.configurations.stable = isStableConfig(entry.Cmd.GetServers())
+	} else if snapshotMeta.Servers != "" {
+		r.configurations.lastConfigLogIndex = snapshotMeta.ConfigIndex
+		r.configurations.stable = isStableConfig(snapshotMeta.config())
+	} else {
+		return
+	}
+	r.updateConfiguration()
+}
+
+//the metadata to save along with a snapshot including log entries up to the given one
+func (r *Raft) newSnapshotMeta(lastIncluded *pb.Entry) SnapshotMeta {
+	servers, configIndex := r.configAsOf(lastIncluded.Index)
+	return newSnapshotMeta(lastIncluded, servers, configIndex)
+}
+
+func newSnapshotMeta(lastIncluded *pb.Entry, servers *pb.Servers, configIndex int64) SnapshotMeta {
+	return SnapshotMeta{
+		LastIncludedIndex: lastIncluded.Index,
+		LastIncludedTerm:  lastIncluded.Term,
+		Servers:           servers.GetCurrList(),
+		NewServers:        servers.GetNewList(),
+		Learners:          servers.GetLearners(),
+		TargetServers:     servers.GetTargetList(),
+		Members:           servers.GetMembers(),
+		ConfigIndex:       configIndex}
+}
+
+//to find the latest configuration entry in the log, return false if it has been compacted
+func (r *Raft) findLastConfigEntry() (*pb.Entry, bool) {
+	for i := len(r.log) - 1; i >= 0; i-- {
+		if r.log[i].Cmd != nil && r.log[i].Cmd.Operation == pb.Op_CONFIG_CHG {
+			return r.log[i], true
+		}
+	}
+	return nil, false
+}
+
+//once the joint configuration is committed, the leader appends the new configuration as the second phase of
+//the membership change, it is a no-op if the latest config entry is not an applied joint configuration
+func (r *Raft) appendNewConfiguration() {
+	jointIndex := r.configurations.lastConfigLogIndex
+	servers, ok := r.configEntryAt(jointIndex)
+	if !ok || servers.GetNewList() == "" || jointIndex > r.lastApplied {
+		return
+	}
+
+	r.appendConfigEntry(&pb.Servers{CurrList: servers.NewList}, jointIndex)
+}
+
+//the leader appends a config entry following up the one at fromIndex, the client waiting for the change to
+//complete now waits for the new entry
+func (r *Raft) appendConfigEntry(servers *pb.Servers, fromIndex int64) {
+	index := r.getLastLogIndex() + 1
+	cmd := &pb.Command{Operation: pb.Op_CONFIG_CHG, Arg: &pb.Command_Servers{Servers: r.withMembers(servers)}}
+	r.addLogEntry(&pb.Entry{Term: r.currentTerm, Index: index, Cmd: cmd})
+
+	if responseChan, ok := r.clientsResponse[fromIndex]; ok {
+		r.clientsResponse[index] = responseChan
+	}
+
+	r.configurations.stable = false
+	r.configurations.lastConfigLogIndex = index
+
+	previous := r.peerClients
+	r.updateConfiguration()
+	r.updatePeerClients()
+	r.updateQuorumSize()
+	r.updateLeaderVolatileStatesAfterConfigChange()
+	r.persist()
+
+	r.departing = make(map[string]pb.RaftClient)
+	for p, c := range previous {
+		if !r.isMember(p) {
+			r.departing[p] = c
+		}
+	}
 }
 
 func (r *Raft) leaderStatePrep() {
@@ -185,6 +520,11 @@ func (r *Raft) leaderStatePrep() {
 	//initialise leader's volatile state
 	r.nextIndex = make(map[string]int64)
 	r.matchIndex = make(map[string]int64)
+	r.lastContact = make(map[string]time.Time)
+	r.peerAckRound = make(map[string]int64)
+	r.peerAckTime = make(map[string]time.Time)
+	r.streams = make(map[string]*replicationStream)
+	r.departing = nil
 	if r.clientsResponse == nil {
 		r.clientsResponse = make(map[int64]chan pb.Result)
 		log.Printf("Leader state prep, creating a new client response chan map.")
@@ -197,7 +537,7 @@ func (r *Raft) leaderStatePrep() {
 	}
 
 	index := r.getLastLogIndex() + 1
-	for _, peer := range *r.getServerList() {
+	for _, peer := range *r.getMembers() {
 		if peer == r.me {
 			continue
 		}
@@ -205,12 +545,17 @@ func (r *Raft) leaderStatePrep() {
 		//match index is a conservative measurement of what prefix of the log the leader shares with given followers
 		//which we won't know beforehead, initialised to 0, essentially mean none of entries
 		r.matchIndex[peer] = 0
+		//give every peer a full election timeout to reply before check quorum counts it as lost
+		r.lastContact[peer] = time.Now()
 	}
+
+	//e.g. the servers of a static cluster only know the raft addresses of each other
+	r.maybeRecordOwnAddresses()
 }
 
 func (r *Raft) updateLeaderVolatileStatesAfterConfigChange() {
 	index := r.getLastLogIndex() + 1
-	for _, peer := range *r.getServerList() {
+	for _, peer := range *r.getMembers() {
 		if peer == r.me {
 			continue
 		}
@@ -223,6 +568,50 @@ func (r *Raft) updateLeaderVolatileStatesAfterConfigChange() {
 		if _, ok := r.matchIndex[peer]; !ok {
 			r.matchIndex[peer] = 0
 		}
+		if _, ok := r.lastContact[peer]; !ok {
+			r.lastContact[peer] = time.Now()
+		}
+	}
+}
+
+//a leader alone in the configuration has its entries on a majority as soon as they are persisted,
+//there is no append entries response to commit them on
+func (r *Raft) commitAlone(s *KVStore) {
+	if r.state == leader && r.quorumSize == 1 && r.isPeer(r.me) && r.commitIndex < r.getLastLogIndex() {
+		r.persist()
+		r.commitIndex = r.getLastLogIndex()
+		r.ProcessLogs(s)
+	}
+}
+
+//whether the leader has heard from a majority of the current configuration within the minimum election timeout
+func (r *Raft) hasQuorumContact() bool {
+	contactCount := int64(0)
+	if r.isPeer(r.me) { //only if the leader is in current config, count itself
+		contactCount = 1
+	}
+	for _, peer := range *r.getServerList() {
+		if peer == r.me {
+			continue
+		}
+		if time.Since(r.lastContact[peer]) < ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond {
+			contactCount++
+		}
+	}
+	return contactCount >= r.quorumSize
+}
+
+//fail all the client requests still waiting for their log entries to be committed,
+//so they don't hang after we stop being able to commit anything as leader
+func (r *Raft) abortPendingClientRequests(msg string) {
+	for index, responseChan := range r.clientsResponse {
+		//use select to do non-blocking send
+		select {
+		case responseChan <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: msg}}}:
+			log.Printf("Aborted pending client request, index: %d.", index)
+		default:
+		}
+		delete(r.clientsResponse, index)
 	}
 }
 
@@ -232,17 +621,18 @@ func (r *Raft) updateQuorumSize() {
 
 func (r *Raft) updatePeerClients() {
 	r.peerClients = make(map[string]pb.RaftClient)
-	for _, peer := range *r.getServerList() {
+	for _, peer := range *r.getMembers() {
 		if peer == r.me { //except itself
 			continue
 		}
-		client, err := r.connectToPeer(peer)
+		address := r.memberAddresses(peer).RaftAddress
+		client, err := r.connectToPeer(address)
 		if err != nil {
 			log.Fatalf("Failed to connect to GRPC server %v", err)
 		}
 
 		r.peerClients[peer] = client
-		log.Printf("Connected to %v", peer)
+		log.Printf("Connected to %v at %v", peer, address)
 	}
 }
 
@@ -276,7 +666,13 @@ func (r *Raft) newVoteCounter() voteInfo {
 }
 
 func (r *Raft) fallbackToFollower() {
+	if r.state == removed && !r.isMember(r.me) {
+		//a removed server stays parked until it is added back
+		return
+	}
 	r.state = follower
+	r.preVoting = false
+	r.abortPendingReads()
 	// reset the election timer & stop heartbeat timer
 	restartTimer(r.electionTimer, randomDuration(r.randSeed))
 	stopTimer(r.heartBeatTimer)
@@ -290,6 +686,14 @@ func (r *Raft) deleteEntryFrom(index int64) {
 		sliceIndex := index - firstIndex
 		r.log = r.log[:sliceIndex]
 	}
+
+	//the deleted entries have to be dropped from the wal as well on next persist
+	if index <= r.persistedLogIndex {
+		r.persistedLogIndex = index - 1
+		if r.logTruncatedFrom == 0 || index < r.logTruncatedFrom {
+			r.logTruncatedFrom = index
+		}
+	}
 }
 
 func (r *Raft) deleteAllEntries() {
@@ -332,19 +736,110 @@ func (r *Raft) getLogEntry(index int64) (*pb.Entry, bool) {
 	}
 }
 
+// the hint a follower replies when the entry at prevLogIndex doesn't match the leader's:
+// the term of our entry at prevLogIndex and the first index we hold for that term,
+// or term 0 and the index right after our log if prevLogIndex is beyond it.
+func (r *Raft) conflictHint(prevLogIndex int64) (conflictTerm int64, conflictIndex int64) {
+	if prevLogIndex > r.getLastLogIndex() {
+		return 0, r.getLastLogIndex() + 1
+	}
+	entry, ok := r.getLogEntry(prevLogIndex)
+	if !ok {
+		//prevLogIndex is covered by our snapshot, everything up to the first log entry is committed
+		return 0, r.getFirstLogIndex() + 1
+	}
+
+	conflictIndex = prevLogIndex
+	for conflictIndex > r.getFirstLogIndex() {
+		prev, _ := r.getLogEntry(conflictIndex - 1)
+		if prev.Term != entry.Term {
+			break
+		}
+		conflictIndex--
+	}
+	return entry.Term, conflictIndex
+}
+
+// the nextIndex of the peer after it rejected an append entry with the given conflict hint,
+// it skips the whole conflicting term instead of a single entry.
+func (r *Raft) nextIndexAfterConflict(peer string, ret *pb.AppendEntriesRet) int64 {
+	nextIndex := r.nextIndex[peer] - 1
+	if ret.ConflictIndex > 0 {
+		nextIndex = ret.ConflictIndex
+		if ret.ConflictTerm > 0 {
+			//if we have entries of the conflicting term, the peer agrees with us up to our last one of them
+			for i := r.getLastLogIndex(); i > r.getFirstLogIndex(); i-- {
+				entry, _ := r.getLogEntry(i)
+				if entry.Term == ret.ConflictTerm {
+					nextIndex = i + 1
+					break
+				} else if entry.Term < ret.ConflictTerm {
+					break
+				}
+			}
+		}
+	}
+
+	//never go back past what is known to match, nor beyond our log
+	nextIndex = max(nextIndex, r.matchIndex[peer]+1)
+	if nextIndex > r.getLastLogIndex()+1 {
+		nextIndex = r.getLastLogIndex() + 1
+	}
+	return nextIndex
+}
+
 func (r *Raft) getEntryFrom(index int64) []*pb.Entry {
 	firstIndex := r.log[0].Index
 	sliceIndex := index - firstIndex
 	return r.log[sliceIndex:]
 }
 
+//record the snapshot up to index, and drop the log entries before it except the trailing ones
 func (r *Raft) Compaction(index int64) {
-	log.Printf("Doing compaction, up to index: %d, first entry index: %d.", index, r.getFirstLogIndex())
-	if r.lastSnapshotLogEntry == nil || index > r.lastSnapshotLogEntry.Index && index > r.getFirstLogIndex() {
-		r.lastSnapshotLogEntry, _ = r.getLogEntry(index)
-		r.log = r.getEntryFrom(index)
-		r.persist()
+	if r.lastSnapshotLogEntry != nil && index <= r.lastSnapshotLogEntry.Index {
+		return
+	}
+	entry, ok := r.getLogEntry(index)
+	if !ok {
+		return
+	}
+	r.lastSnapshotLogEntry = &pb.Entry{Term: entry.Term, Index: entry.Index}
+
+	compactIndex := index - r.opts.snapshotTrailing
+	log.Printf("Doing compaction, snapshot up to index: %d, keeping entries from index: %d, first entry index: %d.",
+		index, compactIndex, r.getFirstLogIndex())
+	if compactIndex > r.getFirstLogIndex() {
+		r.log = r.getEntryFrom(compactIndex)
+		r.persistCompactedLog()
+	}
+	r.persist()
+}
+
+//the compaction policy: whether enough entries, bytes or time piled up since the last snapshot
+//the snapshot records the configuration, so membership changes in progress don't hold compaction back
+func (r *Raft) shouldSnapshot() bool {
+	if r.snapshotting {
+		return false
+	}
+	var snapshotIndex int64
+	if r.lastSnapshotLogEntry != nil {
+		snapshotIndex = r.lastSnapshotLogEntry.Index
+	}
+	applied := r.lastApplied - snapshotIndex
+	if applied <= 0 {
+		return false
+	}
+
+	switch {
+	case r.opts.snapshotEntries > 0 && applied >= r.opts.snapshotEntries:
+		return true
+	//the entries kept before the last snapshot don't count, they alone may be larger than snapshotBytes
+	case r.opts.snapshotBytes > 0 && r.persister.LogSizeSinceReset() >= r.opts.snapshotBytes:
+		return true
+	case r.opts.snapshotInterval > 0 && time.Since(r.lastSnapshotTime) >= r.opts.snapshotInterval:
+		return true
 	}
+	return false
 }
 
 // this check the raft server's log if any committed but unhandled commands
@@ -366,22 +861,11 @@ func (r *Raft) ProcessLogs(s *KVStore) {
 		if entry.Cmd.Operation == pb.Op_CONFIG_CHG {
 			if r.state == leader {
 				//we got a configuration committed, determine next step
-				index := r.getLastLogIndex() + 1
 				if entry.Cmd.GetServers().GetNewList() != "" {
-					cmdOfNewConfig := &pb.Command{Operation: pb.Op_CONFIG_CHG,
-						Arg: &pb.Command_Servers{Servers: &pb.Servers{CurrList: entry.Cmd.GetServers().NewList}}}
-					r.addLogEntry(&pb.Entry{Term: r.currentTerm, Index: index, Cmd: cmdOfNewConfig})
-
-					r.clientsResponse[index] = r.clientsResponse[entry.Index]
-
-					r.configurations.stable = false
-					r.configurations.lastConfigLogIndex = index
-
-					r.updateConfiguration()
-					r.updatePeerClients()
-					r.updateQuorumSize()
-					r.updateLeaderVolatileStatesAfterConfigChange()
-				} else {
+					r.appendNewConfiguration()
+				} else if entry.Cmd.GetServers().GetLearners() != "" {
+					r.maybePromoteLearners()
+				} else if entry.Index == r.configurations.lastConfigLogIndex {
 					//new configuration is committed, we make the new configuration as the latest configuration
 					r.configurations.stable = true
 
@@ -394,50 +878,90 @@ func (r *Raft) ProcessLogs(s *KVStore) {
 						log.Printf("Config changes applied but we lost the channel to send response back to the client due to leadership changes in between.")
 					}
 
-					//leader step down if it is not in the config
-					if !r.isPeer(r.me) {
-						r.fallbackToFollower()
-					}
+					r.releaseDeparting(entry)
 				}
 			}
 
 			log.Printf("Current server configuration: %v", r.getServerList())
 
-			if !r.isPeer(r.me) {
-				log.Printf("Applied committed configuration changes and the current server is not part of the configuration, server: %v",
-					r.me)
-				//go r.Kill()
+			//a leader not in the config steps down for good, like any other removed server
+			if r.isRemovedBy(entry) {
+				r.decommission()
 			}
 
 		} else {
 			op := InputChannelType{command: *entry.Cmd, response: responseChan}
-			s.HandleCommand(op)
+			s.HandleCommand(op, entry.Index)
 		}
 
-		delete(r.clientsResponse, entry.Index)
+		//the client of a change adding learners waits for their promotion
+		if !r.awaitingPromotion(entry.Index) {
+			delete(r.clientsResponse, entry.Index)
+		}
 		log.Printf("Applied committed log to the state machine. Index: %d, Command: %s.", entry.Index, entry.Cmd.Operation)
 	}
 
+	//the joint configuration may have been committed under a previous leader, or restored from a snapshot
+	if r.state == leader {
+		r.appendNewConfiguration()
+		r.maybePromoteLearners()
+		r.maybeRecordOwnAddresses()
+	}
+
 	log.Printf("Length of log: %v", len(r.log))
-	//stop the election timeout timer during compaction which might take longer time than the timeout limit
-	//r.electionTimer.Stop()
-	//check if we reach compaction limit, and do compaction
-	//!!we don't do log compaction if we are undergoing membership changes!!
-	if LOG_COMPACTION_LIMIT != -1 && len(r.log) >= LOG_COMPACTION_LIMIT && r.configurations.stable {
-		write := new(bytes.Buffer)
-		encoder := gob.NewEncoder(write)
-		encoder.Encode(s.store)
-		data := write.Bytes()
-		r.persister.SaveSnapshot(data)
-		log.Printf("Server starts compaction, compact up to index: %v, length of log: %v", r.lastApplied, len(r.log))
-		r.Compaction(r.lastApplied)
-	}
-	//resume the election timer after compaction
-	//restartTimer(r.electionTimer, randomDuration(r.randSeed))
+	//check the compaction policy, and take a snapshot in the background, the log is compacted once it is saved
+	if r.shouldSnapshot() {
+		lastIncluded, _ := r.getLogEntry(r.lastApplied)
+		log.Printf("Server starts snapshot for compaction, up to index: %v, length of log: %v, raft state size: %v",
+			r.lastApplied, len(r.log), r.persister.RaftStateSize())
+		r.startSnapshot(s, lastIncluded)
+	}
+
+	//reads waiting for the state machine to catch up may be served now
+	r.processPendingReads(s)
+}
+
+//whether we have heard from a valid leader within the minimum election timeout,
+//if so, there is no reason for anyone to start an election
+func (r *Raft) hasRecentLeader() bool {
+	return r.leader != "" && time.Since(r.lastLeaderContact) < ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond
+}
+
+// this is used to construct and send a pre-vote request to all peers
+// the term is only increased after a majority tells that they would vote for us
+func (r *Raft) sendPreVoteRequests(peerClients map[string]pb.RaftClient, preVoteResponseChan chan VoteResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.preVoting = true
+	lastLogIndex := r.getLastLogIndex()
+	lastLogTerm := int64(0)
+	if lastLogIndex != 0 {
+		lastLogTerm = r.getLastLogTerm()
+	}
+
+	for p, c := range peerClients {
+		// Send in parallel so we don't wait for each client.
+		log.Printf("Send pre-vote request to %s, nextTerm: %d, lastLogIndex: %d, lastLogTerm: %d",
+			p, r.currentTerm+1, lastLogIndex, lastLogTerm)
+		go func(c pb.RaftClient, p string, currentTerm int64) {
+			ret, err := c.PreVote(context.Background(),
+				&pb.RequestVoteArgs{Term: currentTerm + 1,
+					CandidateID:  r.me,
+					LastLogIndex: lastLogIndex,
+					LasLogTerm:   lastLogTerm,
+					ClusterID:    r.getClusterID()})
+			if err == nil {
+				err = r.checkClusterID(ret.ClusterID)
+			}
+			preVoteResponseChan <- VoteResponse{ret: ret, err: err, peer: p, requestTerm: currentTerm}
+		}(c, p, r.currentTerm)
+	}
 }
 
 // this is used to construct and send a vote request to all peers
-func (r *Raft) sendVoteRequests(peerClients map[string]pb.RaftClient, voteResponseChan chan VoteResponse) {
+// leadershipTransfer is set if the election is started on the leader's TimeoutNow request
+func (r *Raft) sendVoteRequests(peerClients map[string]pb.RaftClient, voteResponseChan chan VoteResponse, leadershipTransfer bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -461,9 +985,14 @@ func (r *Raft) sendVoteRequests(peerClients map[string]pb.RaftClient, voteRespon
 		go func(c pb.RaftClient, p string) {
 			ret, err := c.RequestVote(context.Background(),
 				&pb.RequestVoteArgs{Term: r.currentTerm,
-					CandidateID:  r.me,
-					LastLogIndex: lastLogIndex,
-					LasLogTerm:   lastLogTerm})
+					CandidateID:        r.me,
+					LastLogIndex:       lastLogIndex,
+					LasLogTerm:         lastLogTerm,
+					LeadershipTransfer: leadershipTransfer,
+					ClusterID:          r.getClusterID()})
+			if err == nil {
+				err = r.checkClusterID(ret.ClusterID)
+			}
 			voteResponseChan <- VoteResponse{ret: ret, err: err, peer: p, requestTerm: r.currentTerm}
 		}(c, p)
 	}
@@ -474,6 +1003,8 @@ func (r *Raft) sendApeendEntries(peerClients map[string]pb.RaftClient, appendRes
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	//every broadcast starts a new heartbeat round, whose acknowledgement confirms the leadership for pending reads
+	r.heartbeatRound++
 	for p, c := range peerClients {
 		r.sendApeendEntriesTo(p, c, appendResponseChan, snapshotResponseChan)
 	}
@@ -481,8 +1012,12 @@ func (r *Raft) sendApeendEntries(peerClients map[string]pb.RaftClient, appendRes
 
 // this is used to construct and send an append entry request to given peer (var p)
 func (r *Raft) sendApeendEntriesTo(p string, c pb.RaftClient, appendResponseChan chan AppendResponse, snapshotResponseChan chan InstallSnapshotResponse) {
+	//the peer may have just been removed from the configuration, e.g. by the entries its response let us commit
+	if c == nil {
+		return
+	}
 	var isHeartBeat bool
-	if r.getLastLogIndex() >= r.nextIndex[p] {
+	if r.getLastLogIndex() >= r.nextIndex[p] && r.canSendEntries(p) {
 		isHeartBeat = false
 	} else {
 		isHeartBeat = true
@@ -490,26 +1025,21 @@ func (r *Raft) sendApeendEntriesTo(p string, c pb.RaftClient, appendResponseChan
 
 	prevLogTerm := int64(0)
 	prevLogIndex := r.nextIndex[p] - 1
+	if isHeartBeat && !r.stream(p).probing {
+		//nextIndex runs ahead of what the peer has received while pipelining,
+		//a heartbeat only claims the prefix the peer is known to have
+		prevLogIndex = max(r.matchIndex[p], r.getFirstLogIndex())
+	}
 
-	if prevLogIndex != 0 {
+	//index 0 is only in our log until the first compaction, the peer needs a snapshot after that
+	if prevLogIndex != 0 || r.getFirstLogIndex() > 0 {
 		entry, ok := r.getLogEntry(prevLogIndex)
 		if ok {
 			prevLogTerm = entry.Term
 		} else {
 			//cannot get the  prevLogIndex,
 			//it is snapshot... sned install snapshot to peer
-			installSnapshotArgs := &pb.InstallSnapshotArgs{
-				Term:         r.currentTerm,
-				LeaderID:     r.me,
-				LastLogEntry: r.lastSnapshotLogEntry,
-				Data:         r.persister.ReadSnapshot()}
-			log.Printf("Sent InstallSnapshot request to %s, senderCurrentTerm: %d, prevLogIndex: %d, prevLogTerm: %d, commitIndex: %d, lastSnapshotLogIndex: %d, snapshotSize: %d.",
-				p, r.currentTerm, prevLogIndex, prevLogTerm, r.commitIndex, r.lastSnapshotLogEntry.Index, r.persister.SnapshotSize())
-			go func(c pb.RaftClient, p string) {
-				ret, err := c.InstallSnapshot(context.Background(), installSnapshotArgs)
-				snapshotResponseChan <- InstallSnapshotResponse{ret: ret, err: err, peer: p, requestTerm: r.currentTerm}
-			}(c, p)
-
+			r.sendSnapshotChunkTo(p, c, snapshotResponseChan)
 			return
 		}
 	}
@@ -522,55 +1052,126 @@ func (r *Raft) sendApeendEntriesTo(p string, c pb.RaftClient, appendResponseChan
 			PrevLogIndex: prevLogIndex,
 			PrevLogTerm:  prevLogTerm,
 			LeaderCommit: r.commitIndex,
-			Entries:      nil}
+			Entries:      nil,
+			ClusterID:    r.getClusterID()}
 	} else {
 		if _, ok := r.getLogEntry(prevLogIndex + 1); !ok {
 			//cannot get the  prevLogIndex,
 			//it is snapshot... sned install snapshot to peer
 
 		}
-		entries := r.getEntryFrom(prevLogIndex + 1)
+		entries := r.limitBatch(r.getEntryFrom(prevLogIndex + 1))
 		args = &pb.AppendEntriesArgs{Term: r.currentTerm,
 			LeaderID:     r.me,
 			PrevLogIndex: prevLogIndex,
 			PrevLogTerm:  prevLogTerm,
 			LeaderCommit: r.commitIndex,
-			Entries:      entries}
+			Entries:      entries,
+			ClusterID:    r.getClusterID()}
+
+		st := r.stream(p)
+		st.inflight++
+		if !st.probing {
+			//optimistically assume the peer will accept it, the next request carries the following entries
+			r.nextIndex[p] = entries[len(entries)-1].Index + 1
+		}
 	}
 
 	// Send in parallel so we don't wait for each client.
 	log.Printf("Sent append entry request to %s, senderCurrentTerm: %d, prevLogIndex: %d, prevLogTerm: %d, commitIndex: %d, entriesLen: %d.",
 		p, r.currentTerm, prevLogIndex, prevLogTerm, r.commitIndex, int64(len(args.Entries)))
-	go func(c pb.RaftClient, p string) {
-		ret, err := c.AppendEntries(context.Background(), args)
-		appendResponseChan <- AppendResponse{ret: ret, err: err, peer: p,
-			matchIndex: args.PrevLogIndex + int64(len(args.Entries)), requestTerm: r.currentTerm}
-	}(c, p)
+	go func(c pb.RaftClient, p string, round int64, term int64) {
+		sentAt := time.Now()
+		//a request that never returns would hold its slot of the pipeline forever
+		ctx, cancel := context.WithTimeout(context.Background(), ELECTION_TIMEOUT_UPPER_BOUND*time.Millisecond)
+		defer cancel()
+		ret, err := c.AppendEntries(ctx, args)
+		if err == nil {
+			err = r.checkClusterID(ret.ClusterID)
+		}
+		appendResponseChan <- AppendResponse{ret: ret, err: err, peer: p, prevLogIndex: args.PrevLogIndex,
+			matchIndex: args.PrevLogIndex + int64(len(args.Entries)), requestTerm: term, round: round, sentAt: sentAt}
+	}(c, p, r.heartbeatRound, r.currentTerm)
 }
 
 // put an append entry request to the given raft server's (var r) Append Entry Channel
 // this is used/called to make an append entry request to given peer
 func (r *Raft) AppendEntries(ctx context.Context, arg *pb.AppendEntriesArgs) (*pb.AppendEntriesRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
 	c := make(chan pb.AppendEntriesRet)
 	r.AppendChan <- AppendEntriesInput{arg: arg, response: c}
 	result := <-c
+	result.ClusterID = r.getClusterID()
 	return &result, nil
 }
 
 // put a vote request to the given raft server's (var r) Vote Request Channel
 // this is used/called to make a vote request to given peer
 func (r *Raft) RequestVote(ctx context.Context, arg *pb.RequestVoteArgs) (*pb.RequestVoteRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
 	c := make(chan pb.RequestVoteRet)
 	r.VoteChan <- VoteInput{arg: arg, response: c}
 	result := <-c
+	result.ClusterID = r.getClusterID()
 	return &result, nil
 }
 
+// put a pre-vote request to the given raft server's (var r) Pre-Vote Request Channel
+// this is used/called to make a pre-vote request to given peer
+func (r *Raft) PreVote(ctx context.Context, arg *pb.RequestVoteArgs) (*pb.RequestVoteRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
+	c := make(chan pb.RequestVoteRet, 1)
+	select {
+	case r.PreVoteChan <- VoteInput{arg: arg, response: c}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case result := <-c:
+		result.ClusterID = r.getClusterID()
+		return &result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put a read index request to the given raft server's (var r) Read Index Channel
+// this is used/called by a follower to ask the leader for the read index of a client read
+func (r *Raft) ReadIndex(ctx context.Context, arg *pb.ReadIndexArgs) (*pb.ReadIndexRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
+	//the main loop replies without blocking, the reply waits in the channel until we read it
+	c := make(chan pb.ReadIndexRet, 1)
+	select {
+	case r.ReadIndexChan <- ReadIndexInput{arg: arg, response: c}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case result := <-c:
+		result.ClusterID = r.getClusterID()
+		return &result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // put an install snapshot request to the given raft server's (var r) Install Snapshot Channel
 // this is used/called to make a vote request to given peer
 func (r *Raft) InstallSnapshot(ctx context.Context, arg *pb.InstallSnapshotArgs) (*pb.InstallSnapshotRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
 	c := make(chan pb.InstallSnapshotRet)
 	r.InstallSnapshotChan <- InstallSnapshotInput{arg: arg, response: c}
 	result := <-c
+	result.ClusterID = r.getClusterID()
 	return &result, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/raft/pb"
+)
+
+//a log of entries with the given terms, starting at index first
+func logWithTerms(first int64, terms ...int64) []*pb.Entry {
+	var entries []*pb.Entry
+	for i, term := range terms {
+		entries = append(entries, &pb.Entry{Index: first + int64(i), Term: term})
+	}
+	return entries
+}
+
+func TestConflictHint(t *testing.T) {
+	//the log starts after a snapshot up to index 5
+	r := &Raft{log: logWithTerms(5, 1, 1, 2, 2, 3, 3)}
+
+	tests := []struct {
+		name          string
+		prevLogIndex  int64
+		conflictTerm  int64
+		conflictIndex int64
+	}{
+		{"beyond the log", 12, 0, 11},
+		{"right after the log", 11, 0, 11},
+		{"covered by the snapshot", 3, 0, 6},
+		{"first index of a term", 7, 2, 7},
+		{"last index of a term", 8, 2, 7},
+		{"last entry", 10, 3, 9},
+		{"term of the first entry", 6, 1, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflictTerm, conflictIndex := r.conflictHint(tt.prevLogIndex)
+			if conflictTerm != tt.conflictTerm || conflictIndex != tt.conflictIndex {
+				t.Fatalf("Got conflictTerm: %d, conflictIndex: %d, want conflictTerm: %d, conflictIndex: %d",
+					conflictTerm, conflictIndex, tt.conflictTerm, tt.conflictIndex)
+			}
+		})
+	}
+}
+
+func TestNextIndexAfterConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		matchIndex int64
+		ret        *pb.AppendEntriesRet
+		nextIndex  int64
+	}{
+		{"no hint", 0, &pb.AppendEntriesRet{}, 6},
+		{"follower log too short", 0, &pb.AppendEntriesRet{ConflictIndex: 3}, 3},
+		{"we have the conflicting term", 0, &pb.AppendEntriesRet{ConflictTerm: 2, ConflictIndex: 3}, 5},
+		{"we don't have the conflicting term", 0, &pb.AppendEntriesRet{ConflictTerm: 3, ConflictIndex: 3}, 3},
+		{"conflicting term newer than our log", 0, &pb.AppendEntriesRet{ConflictTerm: 5, ConflictIndex: 2}, 2},
+		{"never before the match index", 4, &pb.AppendEntriesRet{ConflictIndex: 2}, 5},
+		{"never beyond our log", 0, &pb.AppendEntriesRet{ConflictIndex: 10}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Raft{log: logWithTerms(0, 0, 1, 1, 2, 2, 4, 4),
+				nextIndex: map[string]int64{"peer": 7}, matchIndex: map[string]int64{"peer": tt.matchIndex}}
+			if nextIndex := r.nextIndexAfterConflict("peer", tt.ret); nextIndex != tt.nextIndex {
+				t.Fatalf("Got nextIndex %d, want %d", nextIndex, tt.nextIndex)
+			}
+		})
+	}
+}
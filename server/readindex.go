@@ -0,0 +1,220 @@
+/*
+	Linearizable reads without appending them to the log (ReadIndex, section 6.4 of Diego's dissertation).
+
+	The leader records its commitIndex as the read index of the request, confirms it is still the leader
+	by a round of heartbeats acknowledged by a majority, waits for the state machine to apply up to the
+	read index, and then serves the read from its local kv-store.
+
+	Followers serve reads too: a follower asks the leader for a read index through the ReadIndex RPC,
+	the leader confirms its leadership the same way before replying, and the follower serves the read
+	from its own kv-store once it has applied up to that index.
+
+	With -read lease, the confirmation round is skipped while the leader holds a lease: a majority has
+	acknowledged heartbeats sent within the last (minimum election timeout - clock drift bound), and these
+	servers won't vote for anyone else within the minimum election timeout after hearing from the leader.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"github.com/raft/pb"
+)
+
+const (
+	readModeLog       = 1
+	readModeReadIndex = 2
+	readModeLease     = 3
+)
+
+func parseReadMode(mode string) (int, error) {
+	switch mode {
+	case "log":
+		return readModeLog, nil
+	case "read-index":
+		return readModeReadIndex, nil
+	case "lease":
+		return readModeLease, nil
+	}
+	return 0, fmt.Errorf("Unknown read mode %q, should be one of log, read-index or lease", mode)
+}
+
+// A read request waiting to be served
+type readRequest struct {
+	op        InputChannelType
+	readIndex int64
+	//the heartbeat round that has to be acknowledged by a majority to confirm our leadership
+	round     int64
+	confirmed bool
+
+	//set if the leader is confirming the read index for a follower, it replies the index instead of the value
+	indexResponse chan pb.ReadIndexRet
+	//set if we are a follower and got the read index from the leader
+	forwarded bool
+}
+
+//the read index is only safe once the leader has committed an entry in its own term,
+//before that its commitIndex might be behind the one of the previous leader
+func (r *Raft) hasCommittedInCurrentTerm() bool {
+	entry, ok := r.getLogEntry(r.commitIndex)
+	return ok && entry.Term == r.currentTerm
+}
+
+//queue a read to be served once the next heartbeat round confirms our leadership (unless already confirmed by lease)
+//the caller is responsible to start that round by sending append entries to the peers
+func (r *Raft) addPendingRead(op InputChannelType, confirmed bool) {
+	read := &readRequest{op: op, readIndex: r.commitIndex, round: r.heartbeatRound + 1, confirmed: confirmed}
+	log.Printf("Queue read request, readIndex: %d, heartbeat round: %d.", read.readIndex, read.round)
+	r.pendingReads = append(r.pendingReads, read)
+}
+
+//queue a read index request from a follower, replied once the leadership is confirmed
+func (r *Raft) addPendingReadIndex(response chan pb.ReadIndexRet, confirmed bool) {
+	read := &readRequest{indexResponse: response, readIndex: r.commitIndex, round: r.heartbeatRound + 1, confirmed: confirmed}
+	log.Printf("Queue read index request, readIndex: %d, heartbeat round: %d.", read.readIndex, read.round)
+	r.pendingReads = append(r.pendingReads, read)
+}
+
+//queue a read as a follower, to be served once we have applied up to the read index given by the leader
+func (r *Raft) addForwardedRead(op InputChannelType, readIndex int64) {
+	log.Printf("Queue read request served by follower, readIndex: %d, lastApplied: %d.", readIndex, r.lastApplied)
+	r.pendingReads = append(r.pendingReads, &readRequest{op: op, readIndex: readIndex, confirmed: true, forwarded: true})
+}
+
+//whether a majority of the current configuration has acknowledged the given heartbeat round
+func (r *Raft) isRoundAcknowledged(round int64) bool {
+	ackCount := int64(0)
+	if r.isPeer(r.me) { //only if the leader is in current config, count itself
+		ackCount = 1
+	}
+	for _, peer := range *r.getServerList() {
+		if peer == r.me {
+			continue
+		}
+		if r.peerAckRound[peer] >= round {
+			ackCount++
+		}
+	}
+	return ackCount >= r.quorumSize
+}
+
+//whether we still hold the leader lease, i.e. a majority of the current configuration acknowledged
+//heartbeats sent within the lease duration and no leadership transfer is in progress
+func (r *Raft) hasValidLease() bool {
+	//voters grant the vote of a leadership transfer without waiting for our lease to run out,
+	//so the target may be elected within it
+	if r.transfer != nil {
+		return false
+	}
+	lease := ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond - r.opts.clockDrift
+
+	needed := int(r.quorumSize)
+	if r.isPeer(r.me) { //only if the leader is in current config, count itself
+		needed--
+	}
+	if needed <= 0 {
+		return true
+	}
+
+	var ackTimes []time.Time
+	for _, peer := range *r.getServerList() {
+		if peer == r.me {
+			continue
+		}
+		if ackTime, ok := r.peerAckTime[peer]; ok {
+			ackTimes = append(ackTimes, ackTime)
+		}
+	}
+	if len(ackTimes) < needed {
+		return false
+	}
+
+	//the lease starts from the oldest acknowledgement among the latest ones a majority has given
+	sort.Slice(ackTimes, func(i, j int) bool { return ackTimes[i].After(ackTimes[j]) })
+	return time.Since(ackTimes[needed-1]) < lease
+}
+
+//serve the pending reads whose leadership is confirmed and whose read index is applied to the state machine
+func (r *Raft) processPendingReads(s *KVStore) {
+	remaining := r.pendingReads[:0]
+	for _, read := range r.pendingReads {
+		if !read.confirmed && r.state == leader {
+			read.confirmed = r.isRoundAcknowledged(read.round)
+		}
+
+		if read.confirmed && read.indexResponse != nil {
+			//the follower waits for its own state machine, nothing to wait for here
+			select {
+			case read.indexResponse <- pb.ReadIndexRet{Term: r.currentTerm, Success: true, ReadIndex: read.readIndex}:
+				log.Printf("Replied read index %d to follower.", read.readIndex)
+			default:
+				log.Printf("Confirmed read index but we lost the channel to reply to the follower.")
+			}
+		} else if read.confirmed && r.lastApplied >= read.readIndex {
+			result := s.ReadInternal(read.op.command)
+			//use select to do non-blocking send
+			select {
+			case read.op.response <- result:
+				log.Printf("Served read request, readIndex: %d, lastApplied: %d.", read.readIndex, r.lastApplied)
+			default:
+				log.Printf("Served read request but we lost the channel to send response back to the client.")
+			}
+		} else {
+			remaining = append(remaining, read)
+		}
+	}
+	r.pendingReads = remaining
+}
+
+//redirect all the reads pending on our leadership once we are no longer the leader,
+//it is always safe for the client to retry a read.
+//reads served as a follower stay, their read index was confirmed by the leader already.
+func (r *Raft) abortPendingReads() {
+	remaining := r.pendingReads[:0]
+	for _, read := range r.pendingReads {
+		if read.forwarded {
+			remaining = append(remaining, read)
+			continue
+		}
+
+		//use select to do non-blocking send
+		if read.indexResponse != nil {
+			select {
+			case read.indexResponse <- pb.ReadIndexRet{Term: r.currentTerm, Success: false}:
+			default:
+			}
+		} else {
+			select {
+			case read.op.response <- r.redirectResult():
+			default:
+			}
+		}
+	}
+	r.pendingReads = remaining
+}
+
+//ask the leader for a read index on behalf of a client read, so the read can be served by us as a follower
+func (r *Raft) sendReadIndexRequest(op InputChannelType, readIndexResponseChan chan ReadIndexResponse) {
+	c, ok := r.peerClients[r.leader]
+	if !ok {
+		op.response <- r.redirectResult()
+		return
+	}
+
+	log.Printf("Send read index request to leader %s.", r.leader)
+	go func(c pb.RaftClient) {
+		ctx, cancel := context.WithTimeout(context.Background(), ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond)
+		defer cancel()
+		ret, err := c.ReadIndex(ctx, &pb.ReadIndexArgs{FollowerID: r.me, ClusterID: r.getClusterID()})
+		if err == nil {
+			err = r.checkClusterID(ret.ClusterID)
+		}
+		readIndexResponseChan <- ReadIndexResponse{ret: ret, err: err, op: op}
+	}(c)
+}
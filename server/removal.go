@@ -0,0 +1,75 @@
+/*
+	Decommissioning removed servers (sections 4.2.2 and 4.2.3 of Diego's dissertation).
+
+	A server that applies a committed configuration no longer including it is removed: it stops its timers,
+	fails the client requests it still holds, replies a Failure to new ones and parks in the removed state
+	without ever campaigning. The leader that commits such a configuration sends the servers it removed a
+	last AppendEntries with the missing entries and the commit index, so they learn about their removal.
+	A leader that removed itself parks once the final configuration is committed, and the remaining servers
+	elect a new leader among themselves.
+
+	Servers also ignore RequestVote while they hear from a leader, unless the leader is handing its leadership
+	over, so a removed server that missed its removal can't disrupt the cluster with ever-growing terms.
+	A removed server can be added back like any new server.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"github.com/raft/pb"
+)
+
+const removedMsg = "This server has been removed from the cluster."
+
+//whether the committed config entry being applied removes us from the cluster
+func (r *Raft) isRemovedBy(entry *pb.Entry) bool {
+	return entry.Index == r.configurations.lastConfigLogIndex && isStableConfig(entry.Cmd.GetServers()) && !r.isMember(r.me)
+}
+
+//park the server once the committed configuration doesn't include it anymore
+func (r *Raft) decommission() {
+	log.Printf("Server %s is not part of the committed configuration %v, decommissioning it.", r.me, r.getServerList())
+	r.finishLeadershipTransfer(pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: removedMsg}}})
+	r.abortPendingClientRequests(removedMsg)
+	r.abortPendingReads()
+
+	r.state = removed
+	r.leader = ""
+	r.preVoting = false
+	stopTimer(r.electionTimer)
+	stopTimer(r.heartBeatTimer)
+}
+
+//send the servers removed by the committed config entry the entries up to it together with the commit index,
+//they are not our peers anymore so they don't get any other AppendEntries
+func (r *Raft) releaseDeparting(configEntry *pb.Entry) {
+	for p, c := range r.departing {
+		prev, ok := r.getLogEntry(r.matchIndex[p])
+		if !ok || configEntry.Index-prev.Index > int64(r.opts.maxAppendEntries) {
+			log.Printf("Removed server %s is too far behind to learn about its removal.", p)
+			continue
+		}
+
+		args := &pb.AppendEntriesArgs{
+			Term:         r.currentTerm,
+			LeaderID:     r.me,
+			PrevLogIndex: prev.Index,
+			PrevLogTerm:  prev.Term,
+			LeaderCommit: r.commitIndex,
+			Entries:      r.getEntryFrom(prev.Index + 1)[:configEntry.Index-prev.Index],
+			ClusterID:    r.getClusterID()}
+		go func(c pb.RaftClient, p string) {
+			ctx, cancel := context.WithTimeout(context.Background(), ELECTION_TIMEOUT_UPPER_BOUND*time.Millisecond)
+			defer cancel()
+			if _, err := c.AppendEntries(ctx, args); err != nil {
+				log.Printf("Could not tell removed server %s about its removal: %v", p, err)
+			}
+		}(c, p)
+	}
+	r.departing = nil
+}
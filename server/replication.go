@@ -0,0 +1,126 @@
+/*
+	Pipelined replication of the log to each peer.
+
+	Each AppendEntries carries at most -max-append-entries entries and -max-append-bytes bytes. Once a peer
+	has accepted an AppendEntries, the leader keeps up to -max-inflight of them in flight to that peer and
+	advances its nextIndex as soon as they are sent, instead of waiting for the reply. When the peer rejects
+	one or can't be reached, the leader falls back to probing: it rewinds nextIndex and sends one request
+	at a time until the peer accepts again.
+*/
+
+package main
+
+import (
+	"log"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
+)
+
+// The replication state of the leader towards one peer
+type replicationStream struct {
+	//number of AppendEntries with entries sent but not replied yet
+	inflight int
+	//probing for the point where our log matches the peer's, nextIndex is only advanced on success
+	probing bool
+
+	//the snapshot being sent to the peer in chunks, by its last included index, and the next chunk to send
+	snapshotIndex    int64
+	snapshotOffset   int64
+	snapshotInflight bool
+}
+
+func (r *Raft) stream(peer string) *replicationStream {
+	st, ok := r.streams[peer]
+	if !ok {
+		st = &replicationStream{probing: true}
+		r.streams[peer] = st
+	}
+	return st
+}
+
+//whether another AppendEntries with entries can be sent to the peer now
+func (r *Raft) canSendEntries(peer string) bool {
+	st := r.stream(peer)
+	if st.probing {
+		return st.inflight == 0
+	}
+	return st.inflight < r.opts.maxInflight
+}
+
+//cut the entries to the limits of a single AppendEntries, it always keeps at least one entry
+func (r *Raft) limitBatch(entries []*pb.Entry) []*pb.Entry {
+	n := len(entries)
+	if n > r.opts.maxAppendEntries {
+		n = r.opts.maxAppendEntries
+	}
+	size := 0
+	for i := 0; i < n; i++ {
+		size += proto.Size(entries[i])
+		if size > r.opts.maxAppendBytes && i > 0 {
+			n = i
+			break
+		}
+	}
+	return entries[:n:n]
+}
+
+//keep sending entries to the peer as long as it has any to receive and the window allows
+func (r *Raft) fillPipeline(p string, appendResponseChan chan AppendResponse, snapshotResponseChan chan InstallSnapshotResponse) {
+	for r.nextIndex[p] <= r.getLastLogIndex() && r.canSendEntries(p) {
+		inflight := r.stream(p).inflight
+		r.sendApeendEntriesTo(p, r.peerClients[p], appendResponseChan, snapshotResponseChan)
+		if r.stream(p).inflight == inflight { //nothing was sent with entries (e.g. the peer needs a snapshot)
+			return
+		}
+	}
+}
+
+//the peer accepted an AppendEntries
+func (r *Raft) onAppendSuccess(ar AppendResponse) {
+	st := r.stream(ar.peer)
+	if ar.matchIndex > ar.prevLogIndex && st.inflight > 0 {
+		st.inflight--
+	}
+	if st.probing {
+		log.Printf("Peer %s matches our log up to index %d, start pipelining.", ar.peer, ar.matchIndex)
+		st.probing = false
+	}
+}
+
+//the peer rejected an AppendEntries, returns false if it is not a log mismatch and no need to probe
+func (r *Raft) onAppendRejected(ar AppendResponse) bool {
+	st := r.stream(ar.peer)
+	if ar.matchIndex > ar.prevLogIndex && st.inflight > 0 {
+		st.inflight--
+	}
+	//the peer already accepted that prefix, or we have moved on to probe another index
+	if ar.prevLogIndex < r.matchIndex[ar.peer] || (st.probing && ar.prevLogIndex != r.nextIndex[ar.peer]-1) {
+		return false
+	}
+
+	//requests in flight may reach the peer out of order, the peer's log is then just too short for this one.
+	//it will be filled by the earlier requests still in flight, so only send this one again instead of probing.
+	if !st.probing && st.inflight > 0 && ar.ret.ConflictTerm == 0 && ar.ret.ConflictIndex > r.matchIndex[ar.peer] {
+		log.Printf("Append entries to %s arrived out of order, send again from index %d.", ar.peer, ar.prevLogIndex+1)
+		r.nextIndex[ar.peer] = min(r.nextIndex[ar.peer], ar.prevLogIndex+1)
+		return false
+	}
+
+	st.probing = true
+	return true
+}
+
+//the AppendEntries could not reach the peer, the entries sent optimistically after it have to be sent again
+func (r *Raft) onAppendError(ar AppendResponse) {
+	st := r.stream(ar.peer)
+	if ar.matchIndex > ar.prevLogIndex && st.inflight > 0 {
+		st.inflight--
+	}
+	if !st.probing {
+		log.Printf("Lost an append entries request to %s, rewind nextIndex to %d.", ar.peer, r.matchIndex[ar.peer]+1)
+		st.probing = true
+		r.nextIndex[ar.peer] = r.matchIndex[ar.peer] + 1
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/raft/pb"
+)
+
+func TestLimitBatch(t *testing.T) {
+	entries := logWithTerms(1, 1, 1, 1, 1, 1)
+	size := proto.Size(entries[0])
+
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int
+		n          int
+	}{
+		{"within the limits", 10, 10 * size, 5},
+		{"entries limit", 3, 10 * size, 3},
+		{"bytes limit", 10, 2 * size, 2},
+		{"bytes limit between entries", 10, 2*size + size/2, 2},
+		//a single entry larger than the limit still has to be sent
+		{"entry larger than the bytes limit", 10, 1, 1},
+		{"both limits", 2, 3 * size, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Raft{opts: Options{maxAppendEntries: tt.maxEntries, maxAppendBytes: tt.maxBytes}}
+			batch := r.limitBatch(entries)
+			if len(batch) != tt.n {
+				t.Fatalf("Got %d entries, want %d", len(batch), tt.n)
+			}
+			//appending to the batch must not overwrite the log
+			if cap(batch) != len(batch) {
+				t.Fatalf("The batch has room for %d more entries of the log", cap(batch)-len(batch))
+			}
+		})
+	}
+}
+
+func TestCanSendEntries(t *testing.T) {
+	r := &Raft{opts: Options{maxInflight: 3}, streams: make(map[string]*replicationStream)}
+	st := r.stream("peer")
+
+	//until the peer accepts, one request at a time
+	if !st.probing || !r.canSendEntries("peer") {
+		t.Fatalf("A new stream should probe with one request")
+	}
+	st.inflight = 1
+	if r.canSendEntries("peer") {
+		t.Fatalf("A probing stream should have a single request in flight")
+	}
+
+	r.onAppendSuccess(AppendResponse{peer: "peer", prevLogIndex: 0, matchIndex: 2})
+	if st.probing || st.inflight != 0 {
+		t.Fatalf("The stream should pipeline after a success, probing: %v, inflight: %d", st.probing, st.inflight)
+	}
+	for i := 0; i < 3; i++ {
+		if !r.canSendEntries("peer") {
+			t.Fatalf("Request %d should be sent, %d in flight", i+1, st.inflight)
+		}
+		st.inflight++
+	}
+	if r.canSendEntries("peer") {
+		t.Fatalf("No more than maxInflight requests should be in flight")
+	}
+
+	//a heartbeat reply (no entries) doesn't free a slot
+	r.onAppendSuccess(AppendResponse{peer: "peer", prevLogIndex: 2, matchIndex: 2})
+	if st.inflight != 3 {
+		t.Fatalf("A heartbeat reply changed the requests in flight to %d", st.inflight)
+	}
+	r.onAppendSuccess(AppendResponse{peer: "peer", prevLogIndex: 2, matchIndex: 4})
+	if !r.canSendEntries("peer") {
+		t.Fatalf("A reply should free a slot of the pipeline")
+	}
+}
+
+func TestOnAppendRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		probing  bool
+		inflight int
+		ar       AppendResponse
+		probe    bool
+		//nextIndex once the rejection is handled, as the main loop does
+		nextIndex int64
+	}{
+		{"probe rejected", true, 1,
+			AppendResponse{prevLogIndex: 9, matchIndex: 10, ret: &pb.AppendEntriesRet{ConflictTerm: 0, ConflictIndex: 6}}, true, 6},
+		{"probe rejected with a conflicting term", true, 1,
+			AppendResponse{prevLogIndex: 9, matchIndex: 10, ret: &pb.AppendEntriesRet{ConflictTerm: 1, ConflictIndex: 4}}, true, 6},
+		{"reply to an older probe", true, 1,
+			AppendResponse{prevLogIndex: 7, matchIndex: 8, ret: &pb.AppendEntriesRet{ConflictIndex: 6}}, false, 10},
+		{"prefix already accepted", false, 1,
+			AppendResponse{prevLogIndex: 2, matchIndex: 3, ret: &pb.AppendEntriesRet{ConflictIndex: 2}}, false, 10},
+		//the earlier requests still in flight fill the gap, only this one is sent again
+		{"out of order", false, 3,
+			AppendResponse{prevLogIndex: 7, matchIndex: 9, ret: &pb.AppendEntriesRet{ConflictIndex: 6}}, false, 8},
+		{"last request in flight", false, 1,
+			AppendResponse{prevLogIndex: 7, matchIndex: 9, ret: &pb.AppendEntriesRet{ConflictIndex: 6}}, true, 6},
+		{"conflicting term while pipelining", false, 3,
+			AppendResponse{prevLogIndex: 7, matchIndex: 9, ret: &pb.AppendEntriesRet{ConflictTerm: 3, ConflictIndex: 5}}, true, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//our log has term 1 up to index 5 and term 2 after, the peer matched up to index 3
+			r := &Raft{log: logWithTerms(0, 0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2),
+				nextIndex: map[string]int64{"peer": 10}, matchIndex: map[string]int64{"peer": 3},
+				streams: map[string]*replicationStream{"peer": {probing: tt.probing, inflight: tt.inflight}}}
+			tt.ar.peer = "peer"
+
+			probe := r.onAppendRejected(tt.ar)
+			if probe != tt.probe {
+				t.Fatalf("onAppendRejected returned %v, want %v", probe, tt.probe)
+			}
+			if probe {
+				r.nextIndex["peer"] = r.nextIndexAfterConflict("peer", tt.ar.ret)
+				if !r.stream("peer").probing {
+					t.Fatalf("The stream should probe after a mismatch")
+				}
+			}
+			if r.nextIndex["peer"] != tt.nextIndex {
+				t.Fatalf("nextIndex is %d, want %d", r.nextIndex["peer"], tt.nextIndex)
+			}
+			if want := tt.inflight - 1; r.stream("peer").inflight != want {
+				t.Fatalf("%d requests in flight, want %d", r.stream("peer").inflight, want)
+			}
+		})
+	}
+}
+
+func TestOnAppendError(t *testing.T) {
+	r := &Raft{nextIndex: map[string]int64{"peer": 10}, matchIndex: map[string]int64{"peer": 3},
+		streams: map[string]*replicationStream{"peer": {inflight: 2}}}
+
+	//the entries sent after the lost request are sent again, from the last index known to match
+	r.onAppendError(AppendResponse{peer: "peer", prevLogIndex: 5, matchIndex: 7})
+	st := r.stream("peer")
+	if !st.probing || st.inflight != 1 || r.nextIndex["peer"] != 4 {
+		t.Fatalf("Got probing: %v, inflight: %d, nextIndex: %d, want probing from index 4 with 1 in flight",
+			st.probing, st.inflight, r.nextIndex["peer"])
+	}
+
+	//already probing, the probe itself is sent again on the next heartbeat
+	r.nextIndex["peer"] = 6
+	r.onAppendError(AppendResponse{peer: "peer", prevLogIndex: 5, matchIndex: 7})
+	if st.inflight != 0 || r.nextIndex["peer"] != 6 {
+		t.Fatalf("Got inflight: %d, nextIndex: %d, want 0 in flight and nextIndex 6", st.inflight, r.nextIndex["peer"])
+	}
+}
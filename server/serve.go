@@ -6,7 +6,6 @@ import (
 	rand "math/rand"
 	"net"
 	"os"
-	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -35,133 +34,271 @@ func RunRaftServer(r *Raft, port int) {
 }
 
 // The main service loop. All modifications to the KV store are run through here.
-func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
+func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int, opts Options) {
 	raft := Raft{AppendChan: make(chan AppendEntriesInput),
 		VoteChan:            make(chan VoteInput),
-		InstallSnapshotChan: make(chan InstallSnapshotInput)}
+		PreVoteChan:         make(chan VoteInput),
+		ReadIndexChan:       make(chan ReadIndexInput),
+		TimeoutNowChan:      make(chan TimeoutNowInput),
+		SnapshotDoneChan:    make(chan SnapshotDone, 1),
+		InstallSnapshotChan: make(chan InstallSnapshotInput),
+		clusterID:           opts.clusterID}
 	// start in a Go routine so it doesn't affect us.
 	go RunRaftServer(&raft, port)
 	//peerClients := getPeerClients(peers)
 
 	appendResponseChan := make(chan AppendResponse)
 	voteResponseChan := make(chan VoteResponse)
+	preVoteResponseChan := make(chan VoteResponse)
+	readIndexResponseChan := make(chan ReadIndexResponse)
+	timeoutNowResponseChan := make(chan TimeoutNowResponse)
 	snapshotResponseChan := make(chan InstallSnapshotResponse)
 
 	raft.mu.Lock()
 	raft.randSeed = r
 	raft.peers = peers
-	raft.persister = MakePersister()
+	raft.opts = opts
+	raft.persister = MakePersister(opts.dataDir)
 	raft.killServer = make(chan int64)
 	raft.electionTimer = time.NewTimer(randomDuration(r))
 	raft.heartBeatTimer = time.NewTimer(HEARTBEAT_TIMEOUT * time.Millisecond)
+	raft.transferTimer = time.NewTimer(ELECTION_TIMEOUT_UPPER_BOUND * time.Millisecond)
+	stopTimer(raft.transferTimer)
 	raft.me = id
 	raft.currentTerm = 0
 	raft.commitIndex = 0
 	raft.lastApplied = 0
 	raft.votedFor = ""
+	raft.lastSnapshotTime = time.Now()
 
-	serverList := peers.Clone()
-	serverList.Set(id) // the configuration should include the current server itself
-	startupConfig := Configuration{servers: serverList}
-	raft.configurations = Configurations{config: startupConfig, lastConfigLogIndex: 0, stable: true}
-	oldConfigCmd := &pb.Command{Operation: pb.Op_CONFIG_CHG,
-		Arg: &pb.Command_Servers{Servers: &pb.Servers{CurrList: startupConfig.servers.String()}}}
-	raft.addLogEntry(&pb.Entry{Term: 0, Index: 0, Cmd: oldConfigCmd})
-	//first dummy term for indexing convenience
-	//raft.addLogEntry(&pb.Entry{Term: 0, Index: 0, Cmd: nil})
+	raft.configurations = Configurations{config: Configuration{servers: &arrayPeers{}}, lastConfigLogIndex: 0, stable: true}
+
+	//the -bootstrap, -join and -peer flags only apply to an empty data directory
+	if raft.readPersist(s) {
+		if opts.bootstrap || len(opts.join) > 0 || len(*peers) > 0 {
+			log.Printf("Restarted from the persisted states, ignoring -bootstrap, -join and -peer.")
+		}
+	} else if opts.bootstrap {
+		if len(*peers) > 0 && raft.getClusterID() == "" {
+			log.Fatalf("All the servers bootstrapping a cluster together must be given the same -cluster-id")
+		}
+		raft.bootstrap(peers)
+	} else if len(opts.join) > 0 {
+		raft.prepareToJoin()
+	} else {
+		log.Fatalf("No Raft states in %s, start with -bootstrap to form a new cluster or -join to be added to one", opts.dataDir)
+	}
+	if raft.isJoining() {
+		if len(opts.join) == 0 {
+			log.Fatalf("The server has not been added to a cluster yet, start it with -join")
+		}
+		go raft.join(opts.join)
+
+		//only a server waiting to be added takes the cluster id of the leader that adds it
+		raft.clusterMu.Lock()
+		raft.adoptClusterIDOnJoin = raft.clusterID == ""
+		raft.clusterMu.Unlock()
+	}
 
 	log.Printf("Current configuration servers: %v", raft.getServerList())
-	raft.updateConfiguration()
 	raft.updatePeerClients()
 	raft.updateQuorumSize()
 
 	//start as follower with an election timeout
 	raft.fallbackToFollower()
+	//we were removed before the restart, the leader stops replicating to the servers a config entry removes
+	//so we normally only hold such an entry once it has been committed
+	if !raft.isMember(raft.me) && raft.configurations.stable && !raft.isJoining() {
+		raft.decommission()
+	}
 
 	raft.mu.Unlock()
 
+	//client requests come in batches so that concurrent requests share the cost of persisting and replicating
+	batches := make(chan []InputChannelType)
+	go batchRequests(s.C, batches, opts.maxBatch, opts.maxBatchWait)
+
 	// to track voting count
 	var vote voteInfo
+	var preVote voteInfo
 
 	// Run forever handling inputs from various channels
 	for {
 		select {
 		/** election timeout -> candidate **/
 		case <-raft.electionTimer.C:
-			log.Printf("Election timeout: %s becomes a candidate requesting vote.", raft.me)
+			if !raft.isPeer(raft.me) {
+				//learners and removed servers don't campaign
+				if raft.state != removed {
+					restartTimer(raft.electionTimer, randomDuration(raft.randSeed))
+				}
+				break
+			}
+			log.Printf("Election timeout: %s starts a pre-vote round before becoming a candidate.", raft.me)
 
-			//initialize vote info every time it becomes candidate
-			vote = raft.newVoteCounter()
+			//initialize pre-vote info every time it starts a pre-vote round
+			preVote = raft.newVoteCounter()
 
-			//send a vote request to all peers
-			raft.sendVoteRequests(raft.peerClients, voteResponseChan)
+			//the term is not touched until we know a majority would vote for us,
+			//so a node that was partitioned away can't disrupt the cluster with a huge term when it comes back
+			raft.sendPreVoteRequests(raft.peerClients, preVoteResponseChan)
+
+			//alone in the configuration (e.g. after removing the other servers) our own votes are a majority
+			if preVote.voteCount >= raft.quorumSize {
+				log.Printf("Single server configuration, %s becomes the leader.", raft.me)
+				vote = raft.newVoteCounter()
+				raft.sendVoteRequests(raft.peerClients, voteResponseChan, false)
+				raft.mu.Lock()
+				raft.preVoting = false
+				raft.leaderStatePrep()
+				raft.mu.Unlock()
+				break
+			}
 
 			// This will also take care of any pesky timeouts that happened while processing the operation.
 			// this also means within timeout period without receiving majority votes, split votes etc...
 			// it will trigger the election process again
 			restartTimer(raft.electionTimer, randomDuration(raft.randSeed))
 		/** client request handling **/
-		case op := <-s.C:
-			//raft.mu.Lock()
-			if raft.state == leader {
-				index := raft.getLastLogIndex() + 1
-				log.Printf("Receive client request, command: %s, assignedIndex: %v.", op.command.Operation, index)
+		case ops := <-batches:
+			//the requests of a batch are appended to the log with a single persist and a single round of append entries
+			appended, confirmLeadership := false, false
+			for i := range ops {
+				op := ops[i]
+				if raft.state == removed {
+					op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: removedMsg}}}
+					continue
+				}
+				//raft.mu.Lock()
+				if raft.state == leader && isReadOp(op.command.Operation) &&
+					raft.opts.readMode != readModeLog && raft.hasCommittedInCurrentTerm() {
+					//reads are served through ReadIndex instead of being appended to the log,
+					//within a valid lease our leadership needs no confirmation,
+					//otherwise start a heartbeat round right away to confirm we are still the leader
+					raft.mu.Lock()
+					leased := raft.opts.readMode == readModeLease && raft.hasValidLease()
+					raft.addPendingRead(op, leased)
+					raft.processPendingReads(s)
+					raft.mu.Unlock()
 
-				raft.mu.Lock()
+					confirmLeadership = confirmLeadership || !leased
+				} else if raft.state == leader && op.command.Operation == pb.Op_TRANSFER_LEADER {
+					raft.mu.Lock()
+					if raft.startLeadershipTransfer(op.command.GetTransfer().Target, op.response) {
+						//bring the target up to date, TimeoutNow is sent once its matchIndex reaches our last log index
+						target := raft.transfer.target
+						raft.sendApeendEntriesTo(target, raft.peerClients[target], appendResponseChan, snapshotResponseChan)
+						raft.maybeSendTimeoutNow(timeoutNowResponseChan)
+					}
+					raft.mu.Unlock()
+				} else if raft.state == leader && op.command.Operation == pb.Op_GET_CONFIG {
+					raft.mu.Lock()
+					op.response <- raft.configurationResult()
+					raft.mu.Unlock()
+				} else if raft.state == leader && raft.transfer != nil {
+					//no new log entries while handing over the leadership, the target has to catch up with a fixed log
+					log.Printf("Leadership transfer to %s in progress, rejecting client request.", raft.transfer.target)
+					op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "Leadership transfer in progress."}}}
+				} else if raft.state == leader {
+					index := raft.getLastLogIndex() + 1
+					log.Printf("Receive client request, command: %s, assignedIndex: %v.", op.command.Operation, index)
+
+					raft.mu.Lock()
+
+					//the kv-store expires client sessions by the time the leader saw the command
+					op.command.Timestamp = time.Now().UnixNano()
+					//and by the timeout of the leader that registered them, whatever the timeout of the others
+					if op.command.Operation == pb.Op_REGISTER_CLIENT {
+						op.command.SessionTimeout = int64(s.sessionTimeout)
+					}
 
-				if op.command.Operation == pb.Op_CONFIG_CHG {
+					//a single server request becomes the change of the whole list computed from our configuration
+					if op.command.Operation == pb.Op_ADD_SERVER || op.command.Operation == pb.Op_REMOVE_SERVER {
+						servers, failure := raft.membershipChange(op.command.Operation, op.command.GetServerChange())
+						if failure != "" {
+							log.Printf("Rejecting %s request: %s", op.command.Operation, failure)
+							op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: failure}}}
+							raft.mu.Unlock()
+							continue
+						}
+						op.command.Operation = pb.Op_CONFIG_CHG
+						op.command.Arg = &pb.Command_Servers{Servers: servers}
+					}
 
-					log.Printf("Change configuration request. %v", op.command.GetServers())
+					if op.command.Operation == pb.Op_CONFIG_CHG {
 
-					if !raft.isEqualToCurrentServerList(op.command.GetServers().CurrList) {
-						//First, verify the provided currList servers is matching
-						log.Printf("The provided current list of servers is not matching the record.")
-						op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "The provided current list of servers is not matching the record"}}}
+						log.Printf("Change configuration request. %v", op.command.GetServers())
 
-					} else if !raft.configurations.stable {
-						//should reject client's config changes request if we are currently having one
-						log.Printf("There is already a pending change configurations request.")
-						op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "There is already a pending change configurations request."}}}
+						if !raft.isEqualToCurrentServerList(op.command.GetServers().CurrList) {
+							//First, verify the provided currList servers is matching
+							log.Printf("The provided current list of servers is not matching the record.")
+							op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "The provided current list of servers is not matching the record"}}}
+
+						} else if !raft.configurations.stable && !raft.learnersCatchingUp() {
+							//should reject client's config changes request if we are currently having one
+							log.Printf("There is already a pending change configurations request.")
+							op.response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "There is already a pending change configurations request."}}}
+
+						} else {
+							//learners that may never catch up don't block the configuration, a new request replaces them
+							if raft.learnersCatchingUp() {
+								raft.abortLearnerChange()
+							}
+							//the servers added by the change join as learners first
+							op.command.Arg = &pb.Command_Servers{Servers: raft.withMembers(raft.newConfigChange(op.command.GetServers()))}
+
+							//var servers arrayPeers
+							//servers.SetArray(strings.Split(op.command.GetServers().ServerList, ","))
+							//raft.configurations.new = Configuration{servers: &servers}
+							//raft.configurations.genMergedConfiguration()
+							//cmdOfMergedConfig := &pb.Command{Operation: pb.Op_CONFIG_CHG,
+							//Arg: &pb.Command_Servers{Servers: &pb.Servers{ServerList: raft.configurations.new.servers.String()}}}
+							raft.addLogEntry(&pb.Entry{Term: raft.currentTerm, Index: index, Cmd: &op.command})
+							raft.clientsResponse[index] = op.response
+							//raft.configurations.oldNewLogIndex = index
+							raft.configurations.lastConfigLogIndex = index
+							raft.configurations.stable = false
+
+							raft.updateConfiguration()
+							raft.updatePeerClients()
+							raft.updateQuorumSize()
+							raft.updateLeaderVolatileStatesAfterConfigChange()
+						}
 
 					} else {
-						//var servers arrayPeers
-						//servers.SetArray(strings.Split(op.command.GetServers().ServerList, ","))
-						//raft.configurations.new = Configuration{servers: &servers}
-						//raft.configurations.genMergedConfiguration()
-						//cmdOfMergedConfig := &pb.Command{Operation: pb.Op_CONFIG_CHG,
-						//Arg: &pb.Command_Servers{Servers: &pb.Servers{ServerList: raft.configurations.new.servers.String()}}}
+						//add the client request to the leader's log first (but it is not yet committed)
 						raft.addLogEntry(&pb.Entry{Term: raft.currentTerm, Index: index, Cmd: &op.command})
 						raft.clientsResponse[index] = op.response
-						//raft.configurations.oldNewLogIndex = index
-						raft.configurations.lastConfigLogIndex = index
-						raft.configurations.stable = false
-
-						raft.updateConfiguration()
-						raft.updatePeerClients()
-						raft.updateQuorumSize()
-						raft.updateLeaderVolatileStatesAfterConfigChange()
 					}
 
+					raft.mu.Unlock()
+					appended = true
+
+					//log.Printf("raft.state: %d", raft.state)
+				} else if isReadOp(op.command.Operation) && raft.opts.readMode != readModeLog &&
+					raft.leader != "" && raft.leader != raft.me {
+					//follower read, get the read index from the leader and serve it locally
+					raft.sendReadIndexRequest(op, readIndexResponseChan)
 				} else {
-					//add the client request to the leader's log first (but it is not yet committed)
-					raft.addLogEntry(&pb.Entry{Term: raft.currentTerm, Index: index, Cmd: &op.command})
-					raft.clientsResponse[index] = op.response
+					//redirect result to send the client to the right leader
+					log.Printf("Peer %s is not leader, redirecting client request to leader %s.", raft.me, raft.leader)
+					op.response <- raft.redirectResult()
 				}
+			}
 
+			if appended {
+				raft.mu.Lock()
 				raft.persist()
+				raft.commitAlone(s)
 				raft.mu.Unlock()
 
 				//instantly send append entry after receiving client request and added to leader's log
-				log.Printf("Trigger append entries request to peers immediately after receving the client request.")
+				log.Printf("Trigger append entries request to peers immediately after receving %d client requests.", len(ops))
+				raft.sendApeendEntries(raft.peerClients, appendResponseChan, snapshotResponseChan)
+			} else if confirmLeadership {
+				//start a heartbeat round right away to confirm we are still the leader for the reads
 				raft.sendApeendEntries(raft.peerClients, appendResponseChan, snapshotResponseChan)
-
-				//log.Printf("raft.state: %d", raft.state)
-			} else {
-				//redirect result to send the client to the right leader
-				log.Printf("Peer %s is not leader, redirecting client request to leader %s.", raft.me, raft.leader)
-				op.response <- pb.Result{Result: &pb.Result_Redirect{Redirect: &pb.Redirect{Server: strings.Split(raft.leader, ":")[0]}}}
 			}
-			//raft.mu.Unlock()
 
 		/** send heartbeats to followers to maintain authority **/
 		case <-raft.heartBeatTimer.C:
@@ -169,6 +306,20 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 
 			//log.Printf("raft.state: %d", raft.state)
 
+			//check quorum: step down if we haven't heard from a majority within an election timeout,
+			//rather than keep accepting client requests that can never be committed
+			raft.mu.Lock()
+			if raft.state == leader && !raft.hasQuorumContact() {
+				log.Printf("Leader %s lost contact with the majority, step down to follower.", raft.me)
+				raft.fallbackToFollower()
+				raft.leader = ""
+				raft.abortPendingClientRequests("Leader lost contact with the majority, the request may or may not be applied.")
+				raft.mu.Unlock()
+				break
+			}
+			raft.commitAlone(s)
+			raft.mu.Unlock()
+
 			//the sendApeendEntries function will determine if the message
 			//will be heartbeat or carring a log to be replicated
 			raft.sendApeendEntries(raft.peerClients, appendResponseChan, snapshotResponseChan)
@@ -180,7 +331,17 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 			raft.mu.Lock()
 			log.Printf("Received append entry from %v.", ae.arg.LeaderID)
 
-			if !raft.isPeer(ae.arg.LeaderID) { //ignore request from non peer
+			//reject request from non peer, until we are added to a cluster the leader isn't in our configuration
+			if !raft.isPeer(ae.arg.LeaderID) && !raft.isJoining() {
+				resp := pb.AppendEntriesRet{Term: raft.currentTerm, Success: false}
+				raft.mu.Unlock()
+				ae.response <- resp
+				break
+			}
+			//a server added without a cluster id joins the cluster of the first leader it hears from,
+			//the id is checked again here in case another cluster's request got in before that
+			if !raft.adoptClusterID(ae.arg.ClusterID) {
+				ae.response <- pb.AppendEntriesRet{Term: raft.currentTerm}
 				raft.mu.Unlock()
 				break
 			}
@@ -208,6 +369,16 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 
 				//save the current leader
 				raft.leader = ae.arg.LeaderID
+				raft.lastLeaderContact = time.Now()
+
+				//we handed over the leadership, it is done once we hear from the new leader
+				if raft.transfer != nil && raft.transfer.target == raft.leader {
+					log.Printf("Leadership transferred to %s.", raft.leader)
+					raft.finishLeadershipTransfer(pb.Result{Result: &pb.Result_S{S: &pb.Success{}}})
+				} else if raft.transfer != nil {
+					raft.finishLeadershipTransfer(pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{
+						Msg: fmt.Sprintf("Leadership transfer failed, %s became the leader instead.", raft.leader)}}})
+				}
 
 				//Verify the last log entry
 				if ae.arg.PrevLogIndex > 0 {
@@ -234,6 +405,11 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 							prevLogTerm, ae.arg.PrevLogTerm)
 						res.Success = false
 					}
+
+					if !res.Success {
+						res.ConflictTerm, res.ConflictIndex = raft.conflictHint(ae.arg.PrevLogIndex)
+						log.Printf("Conflict hint, conflictTerm: %d, conflictIndex: %d.", res.ConflictTerm, res.ConflictIndex)
+					}
 				}
 
 				//process any new entries if we haven't failed any check
@@ -262,15 +438,15 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 						for _, entry := range newEntries {
 							raft.addLogEntry(entry)
 							if entry.Cmd.Operation == pb.Op_CONFIG_CHG {
-								if entry.Cmd.GetServers().GetNewList() != "" {
-									raft.configurations.stable = false
-								} else {
-									raft.configurations.stable = true
-								}
+								raft.configurations.stable = isStableConfig(entry.Cmd.GetServers())
 								raft.configurations.lastConfigLogIndex = entry.Index
 								raft.updateConfiguration()
 								raft.updatePeerClients()
 								raft.updateQuorumSize()
+								if raft.state == removed && raft.isMember(raft.me) {
+									log.Printf("Server %s was added back to the configuration.", raft.me)
+									raft.fallbackToFollower()
+								}
 							}
 
 							log.Printf("Entry appended to peer: %s, index: %d, command: %s.", raft.me, entry.Index, entry.Cmd.Operation)
@@ -279,8 +455,9 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 				}
 
 				//update the commit index if we haven't failed any check
+				//only up to the last entry known to match the leader's log, anything beyond might be stale
 				if res.Success && ae.arg.LeaderCommit > raft.commitIndex {
-					index := min(raft.getLastLogIndex(), ae.arg.LeaderCommit)
+					index := min(ae.arg.PrevLogIndex+int64(len(ae.arg.Entries)), ae.arg.LeaderCommit)
 					raft.commitIndex = index
 					//log.Printf("Peer: %s, commitIndex: %d.", raft.me, raft.commitIndex)
 
@@ -302,8 +479,11 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 		/** handle vote request from other raft peers **/
 		case vreq := <-raft.VoteChan:
 			raft.mu.Lock()
-			if !raft.isPeer(vreq.arg.CandidateID) { //ignore request from non peer
+			if !raft.isPeer(vreq.arg.CandidateID) {
+				//ignore request from non peer, e.g. a removed server, but reply so that its request doesn't hang
+				resp := pb.RequestVoteRet{Term: raft.currentTerm, VoteGranted: false}
 				raft.mu.Unlock()
+				vreq.response <- resp
 				break
 			}
 			log.Printf("Received vote request from %v", vreq.arg.CandidateID)
@@ -316,6 +496,12 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 			if vreq.arg.Term < raft.currentTerm {
 				log.Printf("Rejecting vote request from %v since current term is greater than request vote term (%d vs %d)",
 					vreq.arg.CandidateID, raft.currentTerm, vreq.arg.Term)
+			} else if !vreq.arg.LeadershipTransfer && (raft.state == leader || raft.hasRecentLeader()) {
+				//a server that lost the leader, e.g. one removed from the configuration, can't disrupt us while we
+				//hear from the leader; the leader lease also relies on no one being elected within the minimum
+				//election timeout after a majority heard from the leader
+				log.Printf("Rejecting vote request from %v since we are still in contact with leader %s",
+					vreq.arg.CandidateID, raft.leader)
 			} else if raft.lastVoteTerm == vreq.arg.Term && raft.votedFor != vreq.arg.CandidateID {
 				log.Printf("Rejecting vote request from %v since already voted for %s for vote term %d.",
 					vreq.arg.CandidateID, raft.votedFor, vreq.arg.Term)
@@ -360,10 +546,143 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 			raft.mu.Unlock()
 			vreq.response <- resp
 
+		/** handle pre-vote request from other raft peers **/
+		case pvreq := <-raft.PreVoteChan:
+			raft.mu.Lock()
+			if !raft.isPeer(pvreq.arg.CandidateID) {
+				//ignore request from non peer, e.g. a removed server, but reply so that its request doesn't hang
+				resp := pb.RequestVoteRet{Term: raft.currentTerm, VoteGranted: false}
+				raft.mu.Unlock()
+				pvreq.response <- resp
+				break
+			}
+			log.Printf("Received pre-vote request from %v", pvreq.arg.CandidateID)
+
+			//pre-vote never changes our term, vote or timer
+			resp := pb.RequestVoteRet{
+				Term:        raft.currentTerm,
+				VoteGranted: false,
+			}
+
+			lastLogIndex := raft.getLastLogIndex()
+			lastLogTerm := int64(0)
+			if lastLogIndex != 0 {
+				lastLogTerm = raft.getLastLogTerm()
+			}
+
+			if pvreq.arg.Term < raft.currentTerm {
+				log.Printf("Rejecting pre-vote request from %v since current term is greater than the request term (%d vs %d)",
+					pvreq.arg.CandidateID, raft.currentTerm, pvreq.arg.Term)
+			} else if raft.state == leader || raft.hasRecentLeader() {
+				log.Printf("Rejecting pre-vote request from %v since we are still in contact with leader %s",
+					pvreq.arg.CandidateID, raft.leader)
+			} else if lastLogTerm > pvreq.arg.LasLogTerm ||
+				(lastLogTerm == pvreq.arg.LasLogTerm && lastLogIndex > pvreq.arg.LastLogIndex) {
+				log.Printf("Rejecting pre-vote request from %v since our log is more up-to-date", pvreq.arg.CandidateID)
+			} else {
+				resp.VoteGranted = true
+			}
+
+			raft.mu.Unlock()
+			pvreq.response <- resp
+
+		/** handle read index request from followers **/
+		case rireq := <-raft.ReadIndexChan:
+			raft.mu.Lock()
+			if !raft.isMember(rireq.arg.FollowerID) { //reject request from non peer, learners may serve reads too
+				raft.mu.Unlock()
+				rireq.response <- pb.ReadIndexRet{Term: raft.currentTerm, Success: false}
+				break
+			}
+			log.Printf("Received read index request from %v", rireq.arg.FollowerID)
+
+			if raft.state != leader || raft.opts.readMode == readModeLog || !raft.hasCommittedInCurrentTerm() {
+				raft.mu.Unlock()
+				rireq.response <- pb.ReadIndexRet{Term: raft.currentTerm, Success: false}
+				break
+			}
+
+			leased := raft.opts.readMode == readModeLease && raft.hasValidLease()
+			raft.addPendingReadIndex(rireq.response, leased)
+			raft.processPendingReads(s)
+			raft.mu.Unlock()
+
+			if !leased {
+				raft.sendApeendEntries(raft.peerClients, appendResponseChan, snapshotResponseChan)
+			}
+
+		/** handle read index response from the leader **/
+		case rires := <-readIndexResponseChan:
+			if rires.err != nil || !rires.ret.Success {
+				//the leader can't confirm a read index for us, let the client go to the leader
+				log.Printf("Read index request to leader failed (err: %v), redirecting client request to leader %s.", rires.err, raft.leader)
+				rires.op.response <- raft.redirectResult()
+				break
+			}
+
+			raft.mu.Lock()
+			raft.addForwardedRead(rires.op, rires.ret.ReadIndex)
+			raft.processPendingReads(s)
+			raft.mu.Unlock()
+
+		/** handle TimeoutNow request from the leader handing over its leadership **/
+		case tnreq := <-raft.TimeoutNowChan:
+			raft.mu.Lock()
+			if !raft.isPeer(tnreq.arg.LeaderID) { //reject request from non peer
+				raft.mu.Unlock()
+				tnreq.response <- pb.TimeoutNowRet{Term: raft.currentTerm, Success: false}
+				break
+			}
+			log.Printf("Received TimeoutNow request from %v", tnreq.arg.LeaderID)
+
+			resp := pb.TimeoutNowRet{Term: raft.currentTerm, Success: false}
+			if tnreq.arg.Term < raft.currentTerm || raft.state == leader {
+				raft.mu.Unlock()
+				tnreq.response <- resp
+				break
+			}
+			resp.Success = true
+			raft.preVoting = false
+			raft.mu.Unlock()
+			tnreq.response <- resp
+
+			//start the election right away, skipping the pre-vote round as the leader itself asked for it
+			log.Printf("TimeoutNow: %s becomes a candidate requesting vote.", raft.me)
+			vote = raft.newVoteCounter()
+			raft.sendVoteRequests(raft.peerClients, voteResponseChan, true)
+			restartTimer(raft.electionTimer, randomDuration(raft.randSeed))
+
+		/** handle TimeoutNow response from the target of leadership transfer **/
+		case tnres := <-timeoutNowResponseChan:
+			raft.mu.Lock()
+			if tnres.err != nil || !tnres.ret.Success {
+				log.Printf("TimeoutNow request to %s failed (err: %v).", tnres.peer, tnres.err)
+				if raft.transfer != nil && raft.transfer.target == tnres.peer && tnres.requestTerm == raft.currentTerm {
+					raft.finishLeadershipTransfer(pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{
+						Msg: "Leadership transfer failed, the target did not start an election."}}})
+				}
+			}
+			raft.mu.Unlock()
+
+		/** leadership transfer did not complete within an election timeout **/
+		case <-raft.transferTimer.C:
+			raft.mu.Lock()
+			log.Printf("Leadership transfer timed out.")
+			raft.finishLeadershipTransfer(pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{
+				Msg: "Leadership transfer timed out."}}})
+			raft.mu.Unlock()
+
 		/** handle install snapshot request from other raft peers **/
 		case installSnapshotReq := <-raft.InstallSnapshotChan:
 			raft.mu.Lock()
-			if !raft.isPeer(installSnapshotReq.arg.LeaderID) { //ignore request from non peer
+			if !raft.isPeer(installSnapshotReq.arg.LeaderID) && !raft.isJoining() { //reject request from non peer
+				resp := pb.InstallSnapshotRet{Term: raft.currentTerm, Success: false}
+				raft.mu.Unlock()
+				installSnapshotReq.response <- resp
+				break
+			}
+			if !raft.adoptClusterID(installSnapshotReq.arg.ClusterID) {
+				installSnapshotReq.response <- pb.InstallSnapshotRet{Term: raft.currentTerm}
 				raft.mu.Unlock()
 				break
 			}
@@ -385,6 +704,7 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 				//we will return success to signal leader to update nextIndex, but no log update is required here.
 				log.Printf("Install snapshot ignored, lastIncludedIndex: %v, firstLogIndex: %v, lastApplied: %v.",
 					installSnapshotReq.arg.LastLogEntry.Index, raft.getFirstLogIndex(), raft.lastApplied)
+				resp.Done = true
 			} else {
 				//increase the term if we see a newer one,
 				//and transit to follower if we ever get an installsnapshot call & the term is >= ours
@@ -396,9 +716,23 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 					resp.Term = installSnapshotReq.arg.Term
 				}
 
+				//save the current leader
+				raft.leader = installSnapshotReq.arg.LeaderID
+				raft.lastLeaderContact = time.Now()
+
+				data, complete := raft.receiveSnapshotChunk(installSnapshotReq.arg, &resp)
+				if !complete {
+					raft.persist()
+					raft.mu.Unlock()
+					restartTimer(raft.electionTimer, randomDuration(raft.randSeed))
+					installSnapshotReq.response <- resp
+					break
+				}
+
 				//install snapshot
 				log.Printf("Installing snapshot, lastIncludedIndex: %v", installSnapshotReq.arg.LastLogEntry.Index)
-				raft.persister.SaveSnapshot(installSnapshotReq.arg.Data)
+				arg := installSnapshotReq.arg
+				raft.persister.SaveSnapshot(newSnapshotMeta(arg.LastLogEntry, arg.Config, arg.ConfigIndex), data)
 				raft.lastSnapshotLogEntry = installSnapshotReq.arg.LastLogEntry
 
 				entry, ok := raft.getLogEntry(raft.lastSnapshotLogEntry.Index)
@@ -409,13 +743,22 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 				} else {
 					raft.deleteAllEntries()
 				}
+				raft.persistCompactedLog()
+
+				//the configuration is the one of the snapshot unless our log suffix holds a newer one
+				if arg.Config.GetCurrList() != "" {
+					meta, _ := raft.persister.ReadSnapshotMeta()
+					raft.restoreConfiguration(meta)
+					raft.updatePeerClients()
+					raft.updateQuorumSize()
+					log.Printf("Current server configuration: %v", raft.getServerList())
+				}
 
-				s.ApplySnapshot(installSnapshotReq.arg.Data)
+				s.ApplySnapshot(data)
 				raft.lastApplied = raft.lastSnapshotLogEntry.Index
+				raft.processPendingReads(s)
 				raft.persist()
-
-				//save the current leader
-				raft.leader = installSnapshotReq.arg.LeaderID
+				resp.Done = true
 			}
 
 			//received valid install snapshot RPC from current leader, restart election timer
@@ -476,15 +819,77 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 				raft.mu.Unlock()
 			}
 
+		/** handle pre-vote response from other raft peers **/
+		case pvres := <-preVoteResponseChan:
+			if pvres.err != nil {
+				// Do not do Fatalf here since the peer might be gone but we should survive.
+				log.Printf("Pre-vote request RPC call error (%s): %v", pvres.peer, pvres.err)
+				break
+			}
+
+			raft.mu.Lock()
+			if !raft.isPeer(pvres.peer) { //ignore request from non peer
+				raft.mu.Unlock()
+				break
+			}
+			log.Printf("Peers %s granted pre-vote %v. The peer's current term is %v", pvres.peer, pvres.ret.VoteGranted, pvres.ret.Term)
+
+			//drop the reply if the pre-vote round is over or it was from an older term
+			if !raft.preVoting || pvres.requestTerm != raft.currentTerm {
+				raft.mu.Unlock()
+				break
+			}
+
+			if pvres.ret.Term > raft.currentTerm {
+				log.Printf("Pre-vote Response from %v: current term is older (%d vs %d), fall back to follower.",
+					pvres.peer, raft.currentTerm, pvres.ret.Term)
+				raft.currentTerm = pvres.ret.Term
+				raft.fallbackToFollower()
+
+				raft.persist()
+				raft.mu.Unlock()
+				break
+			}
+
+			startElection := false
+			if pvres.ret.VoteGranted {
+				preVote.mu.Lock()
+				if preVote.voteRecord[pvres.peer] == false {
+					preVote.voteRecord[pvres.peer] = true
+					preVote.voteCount++
+					if preVote.voteCount >= raft.quorumSize {
+						log.Printf("Won pre-vote. Granted pre-votes: %d, %s becomes a candidate requesting vote.", preVote.voteCount, raft.me)
+						raft.preVoting = false
+						startElection = true
+					}
+				}
+				preVote.mu.Unlock()
+			}
+			raft.mu.Unlock()
+
+			if startElection {
+				//initialize vote info every time it becomes candidate
+				vote = raft.newVoteCounter()
+
+				//send a vote request to all peers
+				raft.sendVoteRequests(raft.peerClients, voteResponseChan, false)
+				restartTimer(raft.electionTimer, randomDuration(raft.randSeed))
+			}
+
 		/** handle append entry response from other raft peers **/
 		case ar := <-appendResponseChan:
 			// We received a response to a previous AppendEntries RPC call
 			if ar.err != nil {
 				// Do not do Fatalf here since the peer might be gone but we should survive.
 				log.Printf("Append entry request RPC call error (%s): %v", ar.peer, ar.err)
+				raft.mu.Lock()
+				if raft.state == leader && ar.requestTerm == raft.currentTerm && raft.isMember(ar.peer) {
+					raft.onAppendError(ar)
+				}
+				raft.mu.Unlock()
 			} else {
 				raft.mu.Lock()
-				if !raft.isPeer(ar.peer) { //ignore request from non peer
+				if !raft.isMember(ar.peer) { //ignore request from non peer
 					raft.mu.Unlock()
 					break
 				}
@@ -508,11 +913,22 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 						break
 					}
 
+					//any reply in our term means the peer still recognises us as its leader
+					raft.lastContact[ar.peer] = time.Now()
+					raft.peerAckRound[ar.peer] = max(raft.peerAckRound[ar.peer], ar.round)
+					if ar.sentAt.After(raft.peerAckTime[ar.peer]) {
+						raft.peerAckTime[ar.peer] = ar.sentAt
+					}
+					raft.processPendingReads(s)
+
 					if ar.ret.Success {
 						log.Printf("Got success append entries response from %v", ar.peer)
+						raft.onAppendSuccess(ar)
 
 						raft.nextIndex[ar.peer] = max(raft.nextIndex[ar.peer], ar.matchIndex+1)
 						raft.matchIndex[ar.peer] = max(raft.matchIndex[ar.peer], ar.matchIndex)
+						raft.maybeSendTimeoutNow(timeoutNowResponseChan)
+						raft.maybePromoteLearners()
 						n := raft.matchIndex[ar.peer]
 						log.Printf("peer: %s, peer_matchIndex: %d, peer_nextIndex: %d, leaderCommitIndex: %d.",
 							ar.peer, raft.matchIndex[ar.peer], raft.nextIndex[ar.peer], raft.commitIndex)
@@ -540,12 +956,21 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 								raft.ProcessLogs(s)
 							}
 						}
+
+						//keep the pipeline to the peer full
+						if raft.state == leader {
+							raft.fillPipeline(ar.peer, appendResponseChan, snapshotResponseChan)
+						}
+					} else if !raft.onAppendRejected(ar) {
+						log.Printf("Not probing on failed append entries response from peer:%v, prevLogIndex: %d", ar.peer, ar.prevLogIndex)
+						raft.fillPipeline(ar.peer, appendResponseChan, snapshotResponseChan)
 					} else {
-						log.Printf("Got failed append entries response from peer:%v, peer's term: %d", ar.peer, ar.ret.Term)
+						log.Printf("Got failed append entries response from peer:%v, peer's term: %d, conflictTerm: %d, conflictIndex: %d",
+							ar.peer, ar.ret.Term, ar.ret.ConflictTerm, ar.ret.ConflictIndex)
 
-						//if fail, decrement nextIndex for that peer
+						//if fail, move nextIndex for that peer back past the conflict
 						//and retry append entry
-						raft.nextIndex[ar.peer]--
+						raft.nextIndex[ar.peer] = raft.nextIndexAfterConflict(ar.peer, ar.ret)
 						raft.sendApeendEntriesTo(ar.peer, raft.peerClients[ar.peer], appendResponseChan, snapshotResponseChan)
 					}
 				}
@@ -559,9 +984,15 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 			if installSnapshotResp.err != nil {
 				// Do not do Fatalf here since the peer might be gone but we should survive.
 				log.Printf("Install snapshot request RPC call error (%s): %v", installSnapshotResp.peer, installSnapshotResp.err)
+				raft.mu.Lock()
+				if raft.state == leader && installSnapshotResp.requestTerm == raft.currentTerm && raft.isMember(installSnapshotResp.peer) {
+					//the chunk is sent again on the next heartbeat
+					raft.stream(installSnapshotResp.peer).snapshotInflight = false
+				}
+				raft.mu.Unlock()
 			} else {
 				raft.mu.Lock()
-				if !raft.isPeer(installSnapshotResp.peer) { //ignore request from non peer
+				if !raft.isMember(installSnapshotResp.peer) { //ignore request from non peer
 					raft.mu.Unlock()
 					break
 				}
@@ -585,21 +1016,45 @@ func serve(s *KVStore, r *rand.Rand, peers *arrayPeers, id string, port int) {
 						break
 					}
 
-					if installSnapshotResp.ret.Success {
-						log.Printf("Successfully install snapshot for peer %v", installSnapshotResp.peer)
+					raft.lastContact[installSnapshotResp.peer] = time.Now()
 
-						raft.nextIndex[installSnapshotResp.peer] = max(raft.nextIndex[installSnapshotResp.peer], raft.lastSnapshotLogEntry.Index+1)
-						raft.matchIndex[installSnapshotResp.peer] = max(raft.matchIndex[installSnapshotResp.peer], raft.lastSnapshotLogEntry.Index)
+					st := raft.stream(installSnapshotResp.peer)
+					st.snapshotInflight = false
+					if installSnapshotResp.ret.Success && installSnapshotResp.ret.Done {
+						log.Printf("Successfully install snapshot for peer %v", installSnapshotResp.peer)
 
-					} else {
-						log.Printf("Install snapshot failed for peer %v", installSnapshotResp.peer)
+						raft.nextIndex[installSnapshotResp.peer] = max(raft.nextIndex[installSnapshotResp.peer], installSnapshotResp.lastIncludedIndex+1)
+						raft.matchIndex[installSnapshotResp.peer] = max(raft.matchIndex[installSnapshotResp.peer], installSnapshotResp.lastIncludedIndex)
+						st.snapshotOffset = 0
+
+						raft.sendApeendEntriesTo(installSnapshotResp.peer, raft.peerClients[installSnapshotResp.peer], appendResponseChan, snapshotResponseChan)
+					} else if installSnapshotResp.lastIncludedIndex == st.snapshotIndex {
+						if installSnapshotResp.ret.Success {
+							st.snapshotOffset = installSnapshotResp.offset + installSnapshotResp.length
+						} else {
+							log.Printf("Install snapshot failed for peer %v, resend from offset %d", installSnapshotResp.peer, installSnapshotResp.ret.NextOffset)
+							st.snapshotOffset = installSnapshotResp.ret.NextOffset
+						}
 
+						//send the next chunk right away
+						raft.sendApeendEntriesTo(installSnapshotResp.peer, raft.peerClients[installSnapshotResp.peer], appendResponseChan, snapshotResponseChan)
 					}
 				}
 
 				raft.mu.Unlock()
 			}
 
+		/** a snapshot taken in the background is durable, the log up to it can be discarded **/
+		case done := <-raft.SnapshotDoneChan:
+			raft.mu.Lock()
+			raft.snapshotting = false
+			s.FinishSnapshot()
+			if done.saved {
+				log.Printf("Server starts compaction, compact up to index: %v, length of log: %v", done.lastIncludedIndex, len(raft.log))
+				raft.Compaction(done.lastIncludedIndex)
+			}
+			raft.mu.Unlock()
+
 		/** the server should be shut down **/
 		case <-raft.killServer:
 			log.Printf("Shutting down server: %v", raft.me)
@@ -0,0 +1,143 @@
+/*
+	Client sessions (section 6.3 of Diego's dissertation).
+
+	A client registers a session first, the session id is the log index of the REGISTER_CLIENT entry so
+	every server assigns the same id. Afterwards the client tags each Set / CAS / Clear / Delete with its session id
+	and an increasing sequence number. The kv-store remembers the result of the latest command of every
+	session, a retried command that was already applied gets that result back instead of being applied
+	again.
+
+	Sessions expire when no command was seen from them within the session timeout. The time used is the
+	timestamp the leader put into the command, and the timeout is the one the leader put into the
+	REGISTER_CLIENT entry, so that every server expires the same sessions at the same point of the log.
+*/
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/raft/pb"
+)
+
+const (
+	//keys of the grpc metadata carrying the session of a request
+	clientIDMetadataKey = "client-id"
+	seqMetadataKey      = "seq"
+
+	DEFAULT_SESSION_TIMEOUT = 3600 //in seconds
+
+	//the session id of a request whose session metadata can't be parsed, no session has it
+	malformedClientID = -1
+)
+
+// The state kept by the kv-store for each client session, it is part of the snapshot
+type clientSession struct {
+	LastSeq int64
+	//the result of the command with LastSeq in its protobuf encoding
+	LastResult []byte
+	//timestamp of the latest command of the session
+	LastActive int64
+	//replicated with the registration, 0 in sessions registered before it was, which use DEFAULT_SESSION_TIMEOUT
+	Timeout time.Duration
+}
+
+//read the session id and sequence number of a request, both are 0 if the request carries no session.
+//a request with a session but a missing or malformed sequence number gets sequence number 0, which is rejected,
+//rather than being applied without its session
+func sessionFromContext(ctx context.Context) (clientID int64, seq int64) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, 0
+	}
+	ids, seqs := md[clientIDMetadataKey], md[seqMetadataKey]
+	if len(ids) == 0 {
+		return 0, 0
+	}
+
+	clientID, err := strconv.ParseInt(ids[0], 10, 64)
+	if err != nil {
+		log.Printf("Malformed client id %q: %v", ids[0], err)
+		return malformedClientID, 0
+	}
+	if len(seqs) == 0 {
+		log.Printf("Missing sequence number of client %d", clientID)
+		return clientID, 0
+	}
+	seq, err = strconv.ParseInt(seqs[0], 10, 64)
+	if err != nil {
+		log.Printf("Malformed sequence number %q of client %d: %v", seqs[0], clientID, err)
+		return clientID, 0
+	}
+	return clientID, seq
+}
+
+// Used internally to open a session whose id is the log index of the registration, expiring after the timeout
+// given by the leader. Assumes no racing calls.
+func (s *KVStore) RegisterClientInternal(index int64, timestamp int64, timeout time.Duration) pb.Result {
+	s.sessions[index] = &clientSession{LastActive: timestamp, Timeout: timeout}
+	log.Printf("Registered client session %d.", index)
+	return pb.Result{Result: &pb.Result_Session{Session: &pb.Session{ClientID: index}}}
+}
+
+//drop the sessions that have been idle for longer than the session timeout as of the given timestamp
+func (s *KVStore) expireSessions(timestamp int64) {
+	if timestamp > s.lastTimestamp {
+		s.lastTimestamp = timestamp
+	}
+	for clientID, session := range s.sessions {
+		timeout := session.Timeout
+		if timeout == 0 {
+			timeout = DEFAULT_SESSION_TIMEOUT * time.Second
+		}
+		if time.Duration(s.lastTimestamp-session.LastActive) > timeout {
+			log.Printf("Client session %d expired.", clientID)
+			delete(s.sessions, clientID)
+		}
+	}
+}
+
+//apply the command at most once for its session, apply is only called if the command was not applied before
+func (s *KVStore) applyWithSession(c pb.Command, apply func() pb.Result) pb.Result {
+	if c.ClientID == 0 {
+		return apply()
+	}
+	//sequence numbers start at 1, a new session has LastSeq 0
+	if c.Seq <= 0 {
+		return pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "Invalid session or sequence number."}}}
+	}
+
+	session, ok := s.sessions[c.ClientID]
+	if !ok {
+		return pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{
+			Msg: "Unknown or expired client session, the client should register again."}}}
+	}
+	session.LastActive = s.lastTimestamp
+
+	if c.Seq < session.LastSeq {
+		//the client has seen the response of a later command, nobody is waiting for this one
+		return pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: "Stale request."}}}
+	} else if c.Seq == session.LastSeq {
+		log.Printf("Duplicated request of client %d, seq %d, replying the cached result.", c.ClientID, c.Seq)
+		var result pb.Result
+		if err := proto.Unmarshal(session.LastResult, &result); err != nil {
+			log.Fatalf("Could not decode cached result of client %d: %v", c.ClientID, err)
+		}
+		return result
+	}
+
+	result := apply()
+	data, err := proto.Marshal(&result)
+	if err != nil {
+		log.Fatalf("Could not encode result of client %d: %v", c.ClientID, err)
+	}
+	session.LastSeq = c.Seq
+	session.LastResult = data
+	return result
+}
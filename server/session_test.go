@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/raft/pb"
+)
+
+func TestApplyWithSession(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.RegisterClientInternal(5, 0, 0)
+	applied := 0
+	apply := func() pb.Result {
+		applied++
+		return pb.Result{Result: &pb.Result_Kv{Kv: &pb.KeyValue{Key: "k", Value: strconv.Itoa(applied)}}}
+	}
+
+	steps := []struct {
+		name     string
+		clientID int64
+		seq      int64
+		applied  bool
+		//the value of the result, or the message of the failure
+		value   string
+		failure bool
+	}{
+		{"no session", 0, 0, true, "1", false},
+		{"no session again", 0, 0, true, "2", false},
+		{"unknown session", 7, 1, false, "Unknown or expired client session, the client should register again.", true},
+		{"missing sequence number", 5, 0, false, "Invalid session or sequence number.", true},
+		{"negative sequence number", 5, -1, false, "Invalid session or sequence number.", true},
+		{"malformed client id", malformedClientID, 1, false, "Unknown or expired client session, the client should register again.", true},
+		{"first command", 5, 1, true, "3", false},
+		{"retried command", 5, 1, false, "3", false},
+		{"next command", 5, 2, true, "4", false},
+		{"stale command", 5, 1, false, "Stale request.", true},
+		{"retried next command", 5, 2, false, "4", false},
+		//a gap is fine, e.g. the client gave up on a command
+		{"command after a gap", 5, 4, true, "5", false},
+	}
+	for _, step := range steps {
+		before := applied
+		result := s.applyWithSession(pb.Command{ClientID: step.clientID, Seq: step.seq}, apply)
+		if (applied > before) != step.applied {
+			t.Fatalf("%s: applied: %v, want %v", step.name, applied > before, step.applied)
+		}
+		if step.failure {
+			if msg := result.GetFailure().GetMsg(); msg != step.value {
+				t.Fatalf("%s: got failure %q, want %q", step.name, msg, step.value)
+			}
+		} else if value := result.GetKv().GetValue(); value != step.value {
+			t.Fatalf("%s: got value %q, want %q", step.name, value, step.value)
+		}
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	tests := []struct {
+		name       string
+		lastActive int64
+		timeout    time.Duration
+		now        int64
+		expired    bool
+	}{
+		{"active", 100, 10, 105, false},
+		{"at the timeout", 100, 10, 110, false},
+		{"past the timeout", 100, 10, 111, true},
+		{"default timeout", 0, 0, int64(DEFAULT_SESSION_TIMEOUT * time.Second), false},
+		{"past the default timeout", 0, 0, int64(DEFAULT_SESSION_TIMEOUT*time.Second) + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestKVStore(nil)
+			s.RegisterClientInternal(1, tt.lastActive, tt.timeout)
+			s.expireSessions(tt.now)
+			if _, ok := s.sessions[1]; ok == tt.expired {
+				t.Fatalf("Session expired: %v, want %v", !ok, tt.expired)
+			}
+		})
+	}
+
+	//the time only moves forward, a command with an older timestamp doesn't revive anything
+	s := newTestKVStore(nil)
+	s.RegisterClientInternal(1, 0, 10)
+	s.expireSessions(20)
+	s.RegisterClientInternal(2, 15, 10)
+	s.expireSessions(5)
+	if _, ok := s.sessions[1]; ok {
+		t.Fatalf("Session 1 should be expired")
+	}
+	if _, ok := s.sessions[2]; !ok {
+		t.Fatalf("Session 2 should still be active")
+	}
+}
+
+func TestSessionThroughLog(t *testing.T) {
+	s := newTestKVStore(nil)
+	handle := func(c pb.Command, index int64) pb.Result {
+		response := make(chan pb.Result, 1)
+		s.HandleCommand(InputChannelType{command: c, response: response}, index)
+		return <-response
+	}
+
+	//the timeout given by the leader in the registration entry, not the one of this server
+	s.sessionTimeout = time.Hour
+	result := handle(pb.Command{Operation: pb.Op_REGISTER_CLIENT, Timestamp: 100, SessionTimeout: 50}, 3)
+	clientID := result.GetSession().GetClientID()
+	if clientID != 3 {
+		t.Fatalf("The session id should be the log index 3, got %d", clientID)
+	}
+
+	set := func(seq int64, value string, timestamp int64) pb.Result {
+		return handle(pb.Command{Operation: pb.Op_SET, ClientID: clientID, Seq: seq, Timestamp: timestamp,
+			Arg: &pb.Command_Set{Set: &pb.KeyValue{Key: "k", Value: value}}}, 0)
+	}
+	set(1, "a", 120)
+	//a retry after the value changed gets the result of the first attempt and doesn't overwrite the value
+	s.SetInternal("k", "b")
+	if result := set(1, "a", 140); result.GetKv().GetValue() != "a" {
+		t.Fatalf("Retried command returned %v", result.Result)
+	}
+	if v, _ := s.get("k"); v != "b" {
+		t.Fatalf("Retried command was applied again, value %q", v)
+	}
+
+	//idle for longer than the replicated timeout
+	handle(pb.Command{Operation: pb.Op_GET, Timestamp: 200, Arg: &pb.Command_Get{Get: &pb.Key{Key: "k"}}}, 0)
+	if result := set(2, "c", 200); result.GetFailure() == nil {
+		t.Fatalf("The expired session should be rejected, got %v", result.Result)
+	}
+}
+
+func TestSessionFromContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		md       metadata.MD
+		clientID int64
+		seq      int64
+	}{
+		{"no metadata", nil, 0, 0},
+		{"no session", metadata.Pairs("other", "1"), 0, 0},
+		{"session", metadata.Pairs(clientIDMetadataKey, "4", seqMetadataKey, "2"), 4, 2},
+		{"missing sequence number", metadata.Pairs(clientIDMetadataKey, "4"), 4, 0},
+		{"malformed sequence number", metadata.Pairs(clientIDMetadataKey, "4", seqMetadataKey, "x"), 4, 0},
+		{"malformed client id", metadata.Pairs(clientIDMetadataKey, "x", seqMetadataKey, "2"), malformedClientID, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+			if clientID, seq := sessionFromContext(ctx); clientID != tt.clientID || seq != tt.seq {
+				t.Fatalf("Got session %d, seq %d, want %d, %d", clientID, seq, tt.clientID, tt.seq)
+			}
+		})
+	}
+}
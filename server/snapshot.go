@@ -0,0 +1,136 @@
+/*
+	Snapshots are taken in the background: the kv-store freezes a point-in-time view of its content and keeps
+	later changes aside (copy-on-write), while a goroutine encodes and saves the view. The main loop keeps
+	handling heartbeats and votes in the meantime, and compacts the log once the snapshot is durable.
+
+	Chunked InstallSnapshot (section 7 of the Raft paper).
+
+	The leader sends its snapshot in chunks of SNAPSHOT_CHUNK_SIZE bytes, one chunk in flight per peer, each
+	chunk sent once the previous one is acknowledged. The follower writes the chunks to a temporary file and
+	only installs the snapshot once the last chunk has arrived and the crc32 of the whole snapshot matches.
+	A follower that gets a chunk at an unexpected offset replies the offset it expects, and the leader
+	resends from there.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"github.com/raft/pb"
+)
+
+const SNAPSHOT_CHUNK_SIZE = 1 << 20
+
+// Sent to the main loop once a background snapshot is durable
+type SnapshotDone struct {
+	lastIncludedIndex int64
+	//false if a newer snapshot was installed in the meantime
+	saved bool
+}
+
+// A snapshot being received from the leader
+type incomingSnapshot struct {
+	lastLogEntry *pb.Entry
+	receiver     *SnapshotReceiver
+}
+
+//take a snapshot of the kv-store up to the given entry in the background, the log is compacted on SnapshotDone
+func (r *Raft) startSnapshot(s *KVStore, lastIncluded *pb.Entry) {
+	view := s.BeginSnapshot()
+	meta := r.newSnapshotMeta(lastIncluded)
+	r.snapshotting = true
+	r.lastSnapshotTime = time.Now()
+
+	go func() {
+		start := time.Now()
+		saved := r.persister.SaveSnapshotIfNewer(meta, encodeSnapshot(view))
+		log.Printf("Snapshot up to index %d written in %v.", meta.LastIncludedIndex, time.Since(start))
+		r.SnapshotDoneChan <- SnapshotDone{lastIncludedIndex: meta.LastIncludedIndex, saved: saved}
+	}()
+}
+
+//send the next chunk of our snapshot to the peer unless one is already in flight
+func (r *Raft) sendSnapshotChunkTo(p string, c pb.RaftClient, snapshotResponseChan chan InstallSnapshotResponse) {
+	st := r.stream(p)
+	if st.snapshotInflight {
+		return
+	}
+	//the snapshot may be newer than lastSnapshotLogEntry if one was just saved in the background
+	meta, data, checksum := r.persister.ReadSnapshotWithMeta()
+	if st.snapshotIndex != meta.LastIncludedIndex {
+		//we took a newer snapshot since, start over
+		st.snapshotIndex = meta.LastIncludedIndex
+		st.snapshotOffset = 0
+	}
+
+	offset := min(st.snapshotOffset, int64(len(data)))
+	end := min(offset+SNAPSHOT_CHUNK_SIZE, int64(len(data)))
+	args := &pb.InstallSnapshotArgs{
+		Term:         r.currentTerm,
+		LeaderID:     r.me,
+		LastLogEntry: &pb.Entry{Term: meta.LastIncludedTerm, Index: meta.LastIncludedIndex},
+		Data:         data[offset:end],
+		Offset:       offset,
+		Done:         end == int64(len(data)),
+		Checksum:     checksum,
+		Config:       meta.config(),
+		ConfigIndex:  meta.ConfigIndex,
+		ClusterID:    r.getClusterID()}
+	st.snapshotInflight = true
+
+	log.Printf("Sent InstallSnapshot request to %s, senderCurrentTerm: %d, lastSnapshotLogIndex: %d, offset: %d, chunkSize: %d, snapshotSize: %d.",
+		p, r.currentTerm, meta.LastIncludedIndex, offset, end-offset, len(data))
+	go func(c pb.RaftClient, p string, term int64) {
+		//a hung RPC would leave the chunk in flight forever, the error clears it so it is sent again
+		ctx, cancel := context.WithTimeout(context.Background(), ELECTION_TIMEOUT_UPPER_BOUND*time.Millisecond)
+		defer cancel()
+		ret, err := c.InstallSnapshot(ctx, args)
+		if err == nil {
+			err = r.checkClusterID(ret.ClusterID)
+		}
+		snapshotResponseChan <- InstallSnapshotResponse{ret: ret, err: err, peer: p, requestTerm: term,
+			lastIncludedIndex: args.LastLogEntry.Index, offset: args.Offset, length: int64(len(args.Data))}
+	}(c, p, r.currentTerm)
+}
+
+//take the chunk into the snapshot being received, returns the whole snapshot once the last chunk verifies.
+//ret.NextOffset is set to the offset of the next chunk we expect.
+func (r *Raft) receiveSnapshotChunk(arg *pb.InstallSnapshotArgs, ret *pb.InstallSnapshotRet) (data []byte, complete bool) {
+	in := r.incomingSnapshot
+	if arg.Offset == 0 {
+		//a new transfer, drop whatever we received before
+		if in != nil {
+			in.receiver.Abort()
+		}
+		in = &incomingSnapshot{lastLogEntry: arg.LastLogEntry, receiver: r.persister.NewSnapshotReceiver()}
+		r.incomingSnapshot = in
+	} else if in == nil || in.lastLogEntry.Index != arg.LastLogEntry.Index || in.lastLogEntry.Term != arg.LastLogEntry.Term ||
+		in.receiver.Offset() != arg.Offset {
+		ret.Success = false
+		if in != nil && in.lastLogEntry.Index == arg.LastLogEntry.Index && in.lastLogEntry.Term == arg.LastLogEntry.Term {
+			ret.NextOffset = in.receiver.Offset()
+		}
+		log.Printf("Unexpected snapshot chunk at offset %d, expecting offset %d.", arg.Offset, ret.NextOffset)
+		return nil, false
+	}
+
+	in.receiver.Write(arg.Data)
+	ret.NextOffset = in.receiver.Offset()
+	if !arg.Done {
+		return nil, false
+	}
+
+	r.incomingSnapshot = nil
+	data, ok := in.receiver.Finish(arg.Checksum)
+	if !ok {
+		log.Printf("Checksum mismatch on received snapshot, lastIncludedIndex: %d, discarding it.", arg.LastLogEntry.Index)
+		ret.Success = false
+		ret.NextOffset = 0
+		return nil, false
+	}
+	return data, true
+}
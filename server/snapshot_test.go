@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/raft/pb"
+)
+
+func TestReceiveSnapshotChunk(t *testing.T) {
+	snapshot := []byte("abcdefgh")
+	checksum := crc32.ChecksumIEEE(snapshot)
+	current := &pb.Entry{Index: 10, Term: 2}
+	other := &pb.Entry{Index: 12, Term: 3}
+
+	chunk := func(entry *pb.Entry, offset int64, end int64, checksum uint32) *pb.InstallSnapshotArgs {
+		return &pb.InstallSnapshotArgs{LastLogEntry: entry, Offset: offset, Data: snapshot[offset:end],
+			Done: end == int64(len(snapshot)), Checksum: checksum}
+	}
+
+	type step struct {
+		arg        *pb.InstallSnapshotArgs
+		success    bool
+		nextOffset int64
+		complete   bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{
+			{chunk(current, 0, 3, checksum), true, 3, false},
+			{chunk(current, 3, 6, checksum), true, 6, false},
+			{chunk(current, 6, 8, checksum), true, 8, true},
+		}},
+		{"single chunk", []step{
+			{chunk(current, 0, 8, checksum), true, 8, true},
+		}},
+		{"no transfer in progress", []step{
+			{chunk(current, 3, 6, checksum), false, 0, false},
+		}},
+		{"chunk ahead of the expected offset", []step{
+			{chunk(current, 0, 3, checksum), true, 3, false},
+			{chunk(current, 6, 8, checksum), false, 3, false},
+			{chunk(current, 3, 8, checksum), true, 8, true},
+		}},
+		{"chunk received twice", []step{
+			{chunk(current, 0, 3, checksum), true, 3, false},
+			{chunk(current, 3, 6, checksum), true, 6, false},
+			{chunk(current, 3, 6, checksum), false, 6, false},
+			{chunk(current, 6, 8, checksum), true, 8, true},
+		}},
+		{"chunk of another snapshot", []step{
+			{chunk(current, 0, 3, checksum), true, 3, false},
+			{chunk(other, 3, 6, checksum), false, 0, false},
+		}},
+		{"restarted transfer", []step{
+			{chunk(current, 0, 3, checksum), true, 3, false},
+			{chunk(other, 0, 3, checksum), true, 3, false},
+			{chunk(current, 3, 8, checksum), false, 0, false},
+			{chunk(other, 3, 8, checksum), true, 8, true},
+		}},
+		{"bad checksum", []step{
+			{chunk(current, 0, 3, checksum+1), true, 3, false},
+			{chunk(current, 3, 8, checksum+1), false, 0, false},
+			//the transfer has to start over
+			{chunk(current, 3, 8, checksum), false, 0, false},
+			{chunk(current, 0, 8, checksum), true, 8, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Raft{persister: MakePersister(t.TempDir())}
+			defer r.persister.wal.Close()
+
+			for i, step := range tt.steps {
+				ret := &pb.InstallSnapshotRet{Success: true}
+				data, complete := r.receiveSnapshotChunk(step.arg, ret)
+				if ret.Success != step.success || ret.NextOffset != step.nextOffset || complete != step.complete {
+					t.Fatalf("Step %d: got success: %v, nextOffset: %d, complete: %v, want success: %v, nextOffset: %d, complete: %v",
+						i, ret.Success, ret.NextOffset, complete, step.success, step.nextOffset, step.complete)
+				}
+				if complete && string(data) != string(snapshot) {
+					t.Fatalf("Step %d: received snapshot %q, want %q", i, data, snapshot)
+				}
+			}
+			if r.incomingSnapshot != nil {
+				r.incomingSnapshot.receiver.Abort()
+			}
+		})
+	}
+}
+
+//a peer whose InstallSnapshot never returns, until the request is cancelled
+type hangingSnapshotClient struct {
+	pb.RaftClient
+	hasDeadline chan bool
+}
+
+func (c *hangingSnapshotClient) InstallSnapshot(ctx context.Context, in *pb.InstallSnapshotArgs, opts ...grpc.CallOption) (*pb.InstallSnapshotRet, error) {
+	_, ok := ctx.Deadline()
+	c.hasDeadline <- ok
+	if !ok {
+		return nil, errors.New("no deadline")
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSendSnapshotChunkDeadline(t *testing.T) {
+	r := &Raft{persister: MakePersister(t.TempDir()), streams: make(map[string]*replicationStream)}
+	defer r.persister.wal.Close()
+	r.persister.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 10, LastIncludedTerm: 2}, []byte("snapshot"))
+
+	c := &hangingSnapshotClient{hasDeadline: make(chan bool, 1)}
+	responses := make(chan InstallSnapshotResponse, 1)
+	r.sendSnapshotChunkTo("peer", c, responses)
+	if !r.stream("peer").snapshotInflight {
+		t.Fatalf("The chunk should be in flight")
+	}
+	if !<-c.hasDeadline {
+		t.Fatalf("InstallSnapshot should be sent with a deadline")
+	}
+	//only one chunk in flight per peer
+	r.sendSnapshotChunkTo("peer", c, responses)
+	select {
+	case <-c.hasDeadline:
+		t.Fatalf("A second chunk was sent while one is in flight")
+	default:
+	}
+
+	select {
+	case resp := <-responses:
+		if resp.err == nil {
+			t.Fatalf("A hung InstallSnapshot should return an error")
+		}
+	case <-time.After(2 * ELECTION_TIMEOUT_UPPER_BOUND * time.Millisecond):
+		t.Fatalf("A hung InstallSnapshot never returned")
+	}
+}
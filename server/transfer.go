@@ -0,0 +1,120 @@
+/*
+	Leadership transfer (section 3.10 of Diego's dissertation).
+
+	The leader stops accepting new log entries, brings the target's log up to date, and then sends it
+	a TimeoutNow request so that the target starts an election right away instead of waiting for its
+	election timeout. The transfer is reported successful only once we hear from the target as the new
+	leader; if that doesn't happen within an election timeout, the transfer is aborted.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"github.com/raft/pb"
+)
+
+// A leadership transfer in progress
+type leadershipTransfer struct {
+	target         string
+	response       chan pb.Result
+	timeoutNowSent bool
+}
+
+// The target's reply to a TimeoutNow request
+type TimeoutNowResponse struct {
+	ret         *pb.TimeoutNowRet
+	err         error
+	peer        string
+	requestTerm int64
+}
+
+// Messages that can be passed from the Raft RPC server to the main loop for TimeoutNow
+type TimeoutNowInput struct {
+	arg      *pb.TimeoutNowArgs
+	response chan pb.TimeoutNowRet
+}
+
+//start to hand the leadership over to the target, return false if the request is not valid
+func (r *Raft) startLeadershipTransfer(target string, response chan pb.Result) bool {
+	var msg string
+	if r.transfer != nil {
+		msg = "There is already a leadership transfer in progress."
+	} else if target == r.me {
+		msg = "The target is already the leader."
+	} else if _, ok := r.peerClients[target]; !ok || !r.isPeer(target) {
+		msg = "The target is not part of the current configuration."
+	}
+	if msg != "" {
+		log.Printf("Rejecting leadership transfer to %s: %s", target, msg)
+		response <- pb.Result{Result: &pb.Result_Failure{Failure: &pb.Failure{Msg: msg}}}
+		return false
+	}
+
+	log.Printf("Start leadership transfer to %s.", target)
+	r.transfer = &leadershipTransfer{target: target, response: response}
+	restartTimer(r.transferTimer, ELECTION_TIMEOUT_UPPER_BOUND*time.Millisecond)
+	return true
+}
+
+//send TimeoutNow to the target once its log is as up to date as ours
+func (r *Raft) maybeSendTimeoutNow(timeoutNowResponseChan chan TimeoutNowResponse) {
+	if r.transfer == nil || r.transfer.timeoutNowSent || r.state != leader ||
+		r.matchIndex[r.transfer.target] < r.getLastLogIndex() {
+		return
+	}
+
+	r.transfer.timeoutNowSent = true
+	target := r.transfer.target
+	log.Printf("Target %s caught up to index %d, send TimeoutNow.", target, r.matchIndex[target])
+	go func(c pb.RaftClient, currentTerm int64) {
+		ctx, cancel := context.WithTimeout(context.Background(), ELECTION_TIMEOUT_LOWER_BOUND*time.Millisecond)
+		defer cancel()
+		ret, err := c.TimeoutNow(ctx, &pb.TimeoutNowArgs{Term: currentTerm, LeaderID: r.me, ClusterID: r.getClusterID()})
+		if err == nil {
+			err = r.checkClusterID(ret.ClusterID)
+		}
+		timeoutNowResponseChan <- TimeoutNowResponse{ret: ret, err: err, peer: target, requestTerm: currentTerm}
+	}(r.peerClients[target], r.currentTerm)
+}
+
+//reply to the admin client and clear the leadership transfer
+func (r *Raft) finishLeadershipTransfer(result pb.Result) {
+	if r.transfer == nil {
+		return
+	}
+
+	//use select to do non-blocking send
+	select {
+	case r.transfer.response <- result:
+	default:
+		log.Printf("Leadership transfer finished but we lost the channel to reply to the client.")
+	}
+	r.transfer = nil
+	stopTimer(r.transferTimer)
+}
+
+// put a TimeoutNow request to the given raft server's (var r) TimeoutNow Channel
+// this is used/called by the leader to ask the target of a leadership transfer to start an election
+func (r *Raft) TimeoutNow(ctx context.Context, arg *pb.TimeoutNowArgs) (*pb.TimeoutNowRet, error) {
+	if err := r.checkClusterID(arg.ClusterID); err != nil {
+		return nil, err
+	}
+	c := make(chan pb.TimeoutNowRet, 1)
+	select {
+	case r.TimeoutNowChan <- TimeoutNowInput{arg: arg, response: c}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case result := <-c:
+		result.ClusterID = r.getClusterID()
+		return &result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}